@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+
+	"github.com/jjeffery/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Algorithm is an authenticated encryption algorithm used to encrypt cookies.
+//
+// The algorithm's ID is recorded in each cookie, so a codec can decode cookies
+// encrypted with any of the algorithms provided by this package, regardless of
+// the algorithm it uses for encoding. This allows a deployment to change algorithms
+// without invalidating existing cookies.
+//
+// The wire format of an encoded cookie is the unpadded URL-safe base64 encoding of:
+//
+//	Secretbox:        0x01 | key ID (4 bytes) | nonce | ciphertext
+//	Other algorithms: 0x02 | algorithm ID | key ID (4 bytes) | nonce | ciphertext
+//
+// The key ID is the first four bytes of HMAC-SHA256(keying material, "key id").
+// The key is HKDF-SHA256 of the keying material, with the cookie name as the salt,
+// and with no info for Secretbox, or the algorithm ID as the info for other algorithms.
+// The plaintext is the big-endian 64-bit unix time that the cookie was encoded,
+// followed by the serialized value. The file testdata/vectors.json contains test
+// vectors for each algorithm.
+type Algorithm interface {
+	// ID identifies the algorithm in encoded cookies. IDs less than 128 are
+	// reserved for algorithms provided by this package.
+	ID() byte
+
+	// NewAEAD returns the AEAD cipher for the 32-byte key.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+// Algorithm IDs for the algorithms provided by this package.
+const (
+	secretboxID         = 1
+	aesGCMID            = 2
+	xchacha20Poly1305ID = 3
+)
+
+// Algorithms provided by this package.
+var (
+	// Secretbox is NaCl secretbox (XSalsa20-Poly1305), and is the default
+	// algorithm. It is the only algorithm used by earlier versions of this
+	// package. https://nacl.cr.yp.to/secretbox.html
+	Secretbox Algorithm = secretboxAlgorithm{}
+
+	// AES256GCM is AES-256 in Galois/Counter Mode with a random 96-bit nonce,
+	// for deployments that require FIPS-approved algorithms.
+	AES256GCM Algorithm = aesGCMAlgorithm{}
+
+	// XChaCha20Poly1305 is ChaCha20-Poly1305 with an extended 192-bit nonce.
+	XChaCha20Poly1305 Algorithm = xchacha20Poly1305Algorithm{}
+)
+
+// algorithmByID returns the algorithm with the ID, which is either alg or
+// one of the algorithms provided by this package. It returns nil if there
+// is no algorithm with the ID.
+func algorithmByID(id byte, alg Algorithm) Algorithm {
+	if alg != nil && alg.ID() == id {
+		return alg
+	}
+	for _, builtin := range []Algorithm{Secretbox, AES256GCM, XChaCha20Poly1305} {
+		if builtin.ID() == id {
+			return builtin
+		}
+	}
+	return nil
+}
+
+type secretboxAlgorithm struct{}
+
+func (secretboxAlgorithm) ID() byte { return secretboxID }
+
+func (secretboxAlgorithm) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("invalid key size").With("size", len(key))
+	}
+	aead := &secretboxAEAD{}
+	copy(aead.key[:], key)
+	return aead, nil
+}
+
+type aesGCMAlgorithm struct{}
+
+func (aesGCMAlgorithm) ID() byte { return aesGCMID }
+
+func (aesGCMAlgorithm) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		// aes.NewCipher would accept AES-128 and AES-192 keys
+		return nil, errors.New("invalid key size").With("size", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type xchacha20Poly1305Algorithm struct{}
+
+func (xchacha20Poly1305Algorithm) ID() byte { return xchacha20Poly1305ID }
+
+func (xchacha20Poly1305Algorithm) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.NewX(key)
+}
+
+// secretboxAEAD implements the cipher.AEAD interface using NaCl secretbox.
+// Secretbox does not authenticate additional data, so it must be empty.
+type secretboxAEAD struct {
+	key [32]byte
+}
+
+func (a *secretboxAEAD) NonceSize() int { return 24 }
+
+func (a *secretboxAEAD) Overhead() int { return secretbox.Overhead }
+
+func (a *secretboxAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != 24 || len(additionalData) != 0 {
+		panic("codec: invalid nonce size or additional data for secretbox")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	return secretbox.Seal(dst, plaintext, &n, &a.key)
+}
+
+func (a *secretboxAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != 24 || len(additionalData) != 0 {
+		panic("codec: invalid nonce size or additional data for secretbox")
+	}
+	var n [24]byte
+	copy(n[:], nonce)
+	plaintext, ok := secretbox.Open(dst, ciphertext, &n, &a.key)
+	if !ok {
+		return nil, errInvalidCookie
+	}
+	return plaintext, nil
+}
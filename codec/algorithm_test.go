@@ -0,0 +1,150 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+// testVector is a test vector in testdata/vectors.json. Byte strings are
+// hex encoded.
+type testVector struct {
+	Algorithm      byte   `json:"algorithm"`
+	KeyingMaterial string `json:"keyingMaterial"`
+	KeyID          string `json:"keyID"`
+	Name           string `json:"name"`
+	Key            string `json:"key"`
+	Nonce          string `json:"nonce"`
+	IssuedAt       int64  `json:"issuedAt"`
+	Value          string `json:"value"`
+	Cookie         string `json:"cookie"`
+}
+
+// rawSerializer serializes byte slices as is, so that test vectors do not
+// depend on the serializer.
+type rawSerializer struct{}
+
+func (rawSerializer) Serialize(src interface{}) ([]byte, error) {
+	return src.([]byte), nil
+}
+
+func (rawSerializer) Deserialize(src []byte, dst interface{}) error {
+	*dst.(*[]byte) = append([]byte(nil), src...)
+	return nil
+}
+
+func TestVectors(t *testing.T) {
+	defer restoreStubs()
+	data, err := ioutil.ReadFile("testdata/vectors.json")
+	wantNilError(t, err)
+	var vectors []testVector
+	wantNilError(t, json.Unmarshal(data, &vectors))
+	if len(vectors) == 0 {
+		t.Fatal("got=0, want=test vectors")
+	}
+
+	for i, v := range vectors {
+		alg := algorithmByID(v.Algorithm, nil)
+		if alg == nil {
+			t.Fatalf("%d: unknown algorithm %d", i, v.Algorithm)
+		}
+		var secret secretT
+		copy(secret.KeyingMaterial[:], mustDecodeHex(t, v.KeyingMaterial))
+		keyID := secret.keyID()
+		if got, want := hex.EncodeToString(keyID[:]), v.KeyID; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+		cc := &cookieCodec{
+			KeyingMaterial: secret.KeyingMaterial,
+			KeyID:          keyID,
+			Algorithm:      alg,
+			Serializer:     rawSerializer{},
+		}
+		key, err := cc.key(v.Name, alg)
+		wantNilError(t, err)
+		if got, want := hex.EncodeToString(key), v.Key; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+
+		nonce := mustDecodeHex(t, v.Nonce)
+		randReadFunc = func(data []byte) (int, error) {
+			return copy(data, nonce), nil
+		}
+		timeNowFunc = func() time.Time {
+			return time.Unix(v.IssuedAt, 0)
+		}
+		value := mustDecodeHex(t, v.Value)
+		cookie, err := cc.Encode(v.Name, value)
+		wantNilError(t, err)
+		if got, want := cookie, v.Cookie; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+		var decoded []byte
+		wantNilError(t, cc.Decode(v.Name, v.Cookie, &decoded))
+		if got, want := decoded, value; !bytes.Equal(got, want) {
+			t.Errorf("%d: got=%x, want=%x", i, got, want)
+		}
+	}
+}
+
+func TestAlgorithmMigration(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	db := memory.New().WithTimeNow(timeNowFunc)
+	ctx := context.Background()
+
+	// encode a cookie with each algorithm
+	var cookies []string
+	for _, alg := range []Algorithm{nil, Secretbox, AES256GCM, XChaCha20Poly1305} {
+		codec := &Codec{DB: db, Algorithm: alg}
+		cookie, err := codec.Encode("cookie", "data")
+		wantNilError(t, err)
+		cookies = append(cookies, cookie)
+	}
+	if cookies[0][:2] != cookies[1][:2] {
+		t.Errorf("got=%v, want=same version as %v", cookies[0], cookies[1])
+	}
+
+	// every cookie can be decoded, whatever the algorithm used for encoding
+	for _, alg := range []Algorithm{nil, AES256GCM, XChaCha20Poly1305} {
+		codec := &Codec{DB: db, Algorithm: alg}
+		for i, cookie := range cookies {
+			var value string
+			info, err := codec.DecodeWithInfo("cookie", cookie, &value)
+			wantNilError(t, err)
+			if got, want := value, "data"; got != want {
+				t.Errorf("%d: got=%v, want=%v", i, got, want)
+			}
+			if !info.Current {
+				t.Errorf("%d: got=false, want=true", i)
+			}
+		}
+		wantNilError(t, codec.Refresh(ctx))
+	}
+
+	// keys are different for each algorithm, so a cookie cannot be decoded
+	// by claiming it was encoded by another algorithm
+	sealed, err := base64.RawURLEncoding.DecodeString(cookies[2])
+	wantNilError(t, err)
+	sealed[1] = xchacha20Poly1305ID
+	codec := &Codec{DB: db}
+	err = codec.Decode("cookie", base64.RawURLEncoding.EncodeToString(sealed), new(string))
+	wantError(t, err)
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	wantNilError(t, err)
+	return b
+}
@@ -9,12 +9,15 @@ package codec
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 
@@ -22,7 +25,6 @@ import (
 	"github.com/jjeffery/errors"
 	"github.com/jjeffery/sessions/storage"
 	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
 )
 
 const (
@@ -37,8 +39,27 @@ const (
 	// included to provide backwards-compatibility in case future versions of this package
 	// change the format
 	gobFormat = "gob"
+
+	// wireVersion is the first byte of cookies encoded using secretbox, and is followed
+	// by the key ID. Cookies encoded by earlier versions of this package do not have a
+	// version byte or key ID, and start with the nonce.
+	wireVersion = 1
+
+	// wireVersionAlgorithm is the first byte of cookies encoded using algorithms other
+	// than secretbox, and is followed by the algorithm ID and the key ID.
+	wireVersionAlgorithm = 2
+
+	// keyIDLen is the length of the key ID that identifies the secret used to encode
+	// a cookie.
+	keyIDLen = 4
+
+	// headerLen is the length of the version byte and key ID.
+	headerLen = 1 + keyIDLen
 )
 
+// errInvalidCookie is returned when a cookie cannot be decrypted.
+const errInvalidCookie = decodeError("invalid cookie")
+
 var (
 	// timeNowFunc returns the current time, and can be replaced during testing
 	timeNowFunc = time.Now
@@ -63,6 +84,12 @@ var (
 // is invalid. If zero is passed as the maximum age, then the default maximum age is
 // used.
 //
+// The CookieMaxAge field specifies the maximum age for cookies with particular names,
+// overriding MaxAge. This allows cookies with different lifetimes to share the same
+// secret keying material, for example a short-lived OAuth state cookie and a long-lived
+// session cookie. Secret keying material is kept until the longest maximum age has
+// passed.
+//
 // The rotation period is the time duration between key rotation. If zero is passed
 // as the rotation period, then the rotation period is deemed to be the same as the
 // maximum age. If the rotation period is significantly smaller than the maximum age,
@@ -74,12 +101,39 @@ var (
 //
 // The secret ID is used as the primary key for persisting the secret keying material to
 // the db storage. If a blank string is supplied then a default value ("secret") is used.
+//
+// The key wrapper, if specified, encrypts the secret keying material before it is
+// persisted, so that the secrets cannot be used by anyone who can read the db storage
+// but cannot use the wrapping key. Secrets persisted without a key wrapper can still
+// be read, and are wrapped when the secrets are next rotated. Every process sharing
+// the secrets must have the key wrapper before any of them saves wrapped secrets.
+//
+// The algorithm is used to encrypt cookies. If not specified then NaCl secretbox is
+// used. Cookies encrypted with any of the algorithms in this package can be decoded,
+// so the algorithm can be changed without invalidating existing cookies.
+//
+// Encoded cookies start with a version byte and a short key ID, so that only the secret
+// that encoded a cookie is used to decode it. Cookies encoded by earlier versions of
+// this package do not have a key ID, and are decoded by trying each secret in turn.
+// Once all such cookies have expired, set RejectUnversioned so that invalid cookies
+// are rejected without trying every secret.
 type Codec struct {
 	DB             storage.Provider
 	MaxAge         time.Duration
+	CookieMaxAge   map[string]time.Duration // maximum age by cookie name
 	RotationPeriod time.Duration
 	Serializer     Serializer
 	SecretID       string
+	Algorithm      Algorithm  // algorithm used to encode cookies, Secretbox if nil
+	KeyWrapper     KeyWrapper // encrypts the persisted secrets if not nil
+
+	// RefreshInterval is the time between checks for secrets that have been
+	// rotated or revoked by other processes. It cannot be more than, and defaults
+	// to, MinimumRotationPeriod.
+	RefreshInterval time.Duration
+
+	// RejectUnversioned rejects cookies encoded without a version byte and key ID.
+	RejectUnversioned bool
 
 	mutex sync.RWMutex
 	codec *immutableCodec
@@ -103,6 +157,51 @@ func (c *Codec) Decode(name, value string, dst interface{}) error {
 	return codec.Decode(name, value, dst)
 }
 
+// CookieInfo contains information about a cookie value that has been
+// decoded by DecodeWithInfo.
+type CookieInfo struct {
+	// IssuedAt is the time that the cookie value was encoded.
+	IssuedAt time.Time
+
+	// Current is true if the cookie value was encoded using the current
+	// secret keying material. If false, the cookie value was encoded using
+	// a secret that has since been rotated, and the cookie value should
+	// be re-encoded before that secret is discarded.
+	Current bool
+}
+
+// DecodeWithInfo decodes a cookie value in the same way as Decode, and also
+// returns information about the cookie value. This information can be used to
+// determine whether the cookie needs to be re-encoded.
+func (c *Codec) DecodeWithInfo(name, value string, dst interface{}) (*CookieInfo, error) {
+	codec, err := c.immutableCodec(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return codec.DecodeWithInfo(name, value, dst)
+}
+
+// MAC returns the HMAC-SHA256 of message, using a secret hash key that is
+// persisted with the secret keying material.
+//
+// Unlike the keys used for encrypting cookies, the hash key is not rotated,
+// so the MAC of a message does not change. This makes it suitable for deriving
+// storage keys from secret values such as session IDs.
+func (c *Codec) MAC(ctx context.Context, message []byte) ([]byte, error) {
+	codec, err := c.immutableCodec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if codec.hashKey == [32]byte{} {
+		// only happens if another process without hash key support
+		// saved the secrets record, the key is generated at next refresh
+		return nil, errors.New("hash key not available")
+	}
+	mac := hmac.New(sha256.New, codec.hashKey[:])
+	mac.Write(message)
+	return mac.Sum(nil), nil
+}
+
 // Refresh ensures that the hash and encryption keys are up to date, rotating
 // if necessary.
 //
@@ -114,6 +213,14 @@ func (c *Codec) Refresh(ctx context.Context) error {
 	return err
 }
 
+// MaxAgeFor returns the maximum age for cookies with the given name.
+func (c *Codec) MaxAgeFor(name string) time.Duration {
+	if maxAge := c.CookieMaxAge[name]; maxAge > 0 {
+		return maxAge
+	}
+	return c.maxAge()
+}
+
 func (c *Codec) maxAge() time.Duration {
 	maxAge := c.MaxAge
 	if maxAge <= 0 {
@@ -122,6 +229,32 @@ func (c *Codec) maxAge() time.Duration {
 	return maxAge
 }
 
+// retention returns the time that secret keying material must be kept for,
+// which is the longest maximum age of any cookie.
+func (c *Codec) retention() time.Duration {
+	retention := c.maxAge()
+	for _, maxAge := range c.CookieMaxAge {
+		if maxAge > retention {
+			retention = maxAge
+		}
+	}
+	return retention
+}
+
+func (c *Codec) refreshInterval() time.Duration {
+	if c.RefreshInterval <= 0 || c.RefreshInterval > MinimumRotationPeriod {
+		return MinimumRotationPeriod
+	}
+	return c.RefreshInterval
+}
+
+func (c *Codec) secretID() string {
+	if c.SecretID == "" {
+		return "secret"
+	}
+	return c.SecretID
+}
+
 func (c *Codec) rotationPeriod() time.Duration {
 	rotationPeriod := c.RotationPeriod
 	if rotationPeriod <= 0 {
@@ -165,15 +298,33 @@ func (c *Codec) newImmutableCodec(ctx context.Context) (*immutableCodec, error)
 	if err != nil {
 		return nil, err
 	}
+	return c.newImmutableCodecFromSecrets(cb, now), nil
+}
 
+// newImmutableCodecFromSecrets creates a new immutable codec based on
+// the secret keying material.
+func (c *Codec) newImmutableCodecFromSecrets(cb *secretsT, now time.Time) *immutableCodec {
 	nowUnix := now.Unix()
 
+	// copy the cookie max ages, as the codecs are immutable
+	var cookieMaxAge map[string]time.Duration
+	if len(c.CookieMaxAge) > 0 {
+		cookieMaxAge = make(map[string]time.Duration, len(c.CookieMaxAge))
+		for name, maxAge := range c.CookieMaxAge {
+			cookieMaxAge[name] = maxAge
+		}
+	}
+
 	encoders := make([]securecookie.Codec, 0, len(cb.Secrets)*2)
 	decoders := make([]securecookie.Codec, 0, len(cb.Secrets)*2)
 	for _, secret := range cb.Secrets {
-		codec := &naclCodec{
+		codec := &cookieCodec{
 			KeyingMaterial: secret.KeyingMaterial,
+			Algorithm:      c.Algorithm,
 			Serializer:     c.Serializer,
+			MaxAge:         c.maxAge(),
+			CookieMaxAge:   cookieMaxAge,
+			KeyID:          secret.keyID(),
 		}
 		decoders = append(decoders, codec)
 		if secret.StartAt <= nowUnix {
@@ -188,7 +339,7 @@ func (c *Codec) newImmutableCodec(ctx context.Context) (*immutableCodec, error)
 	nextRotation := time.Unix(cb.Secrets[0].StartAt, 0).Add(c.rotationPeriod())
 
 	// nextRefresh is the time to perform a regular check
-	nextRefresh := now.Add(MinimumRotationPeriod)
+	nextRefresh := now.Add(c.refreshInterval())
 
 	// choose the earliest time of next rotation or next refresh
 	expiresAt := nextRotation
@@ -197,12 +348,15 @@ func (c *Codec) newImmutableCodec(ctx context.Context) (*immutableCodec, error)
 	}
 
 	codec := &immutableCodec{
-		encoders:  encoders,
-		decoders:  decoders,
-		expiresAt: expiresAt,
+		encoders:          encoders,
+		decoders:          decoders,
+		hashKey:           cb.HashKey,
+		expiresAt:         expiresAt,
+		rejectUnversioned: c.RejectUnversioned,
+		algorithm:         c.Algorithm,
 	}
 
-	return codec, nil
+	return codec
 }
 
 // fetchSecrets and, if necessary, rotate the secrets from  the secret store.
@@ -210,21 +364,18 @@ func (c *Codec) fetchSecrets(ctx context.Context, now time.Time) (*secretsT, err
 	if c.DB == nil {
 		return nil, errors.New("Codec.DB cannot be nil")
 	}
-	secretID := c.SecretID
-	if secretID == "" {
-		secretID = "secret"
-	}
+	secretID := c.secretID()
 	rec, err := c.DB.Fetch(ctx, secretID)
 	if err != nil {
 		return nil, err
 	}
 	var cb secretsT
 	if rec != nil {
-		if err = cb.unmarshal(rec.Format, rec.Data); err != nil {
+		if err = c.unmarshalSecrets(ctx, &cb, rec.Format, rec.Data); err != nil {
 			return nil, err
 		}
 	}
-	modified, err := cb.rotate(now, c.rotationPeriod(), c.maxAge())
+	modified, err := cb.rotate(now, c.rotationPeriod(), c.retention())
 	if err != nil {
 		return nil, err
 	}
@@ -234,7 +385,7 @@ func (c *Codec) fetchSecrets(ctx context.Context, now time.Time) (*secretsT, err
 		}
 		oldVersion := rec.Version
 		rec.Version++
-		rec.Format, rec.Data, err = cb.marshal()
+		rec.Format, rec.Data, err = c.marshalSecrets(ctx, &cb)
 		if err != nil {
 			return nil, err
 		}
@@ -247,7 +398,7 @@ func (c *Codec) fetchSecrets(ctx context.Context, now time.Time) (*secretsT, err
 			if err != nil {
 				return nil, err
 			}
-			if err = cb.unmarshal(rec.Format, rec.Data); err != nil {
+			if err = c.unmarshalSecrets(ctx, &cb, rec.Format, rec.Data); err != nil {
 				return nil, err
 			}
 		} else if err != nil {
@@ -268,19 +419,39 @@ type secretT struct {
 	StartAt        int64    // unix time that secret becomes/became active
 }
 
+// keyID returns the key ID that identifies cookies encoded using the secret.
+// It is derived from the keying material, and does not reveal it.
+func (s *secretT) keyID() [keyIDLen]byte {
+	mac := hmac.New(sha256.New, s.KeyingMaterial[:])
+	mac.Write([]byte("key id"))
+	var keyID [keyIDLen]byte
+	copy(keyID[:], mac.Sum(nil))
+	return keyID
+}
+
 // secretsT contains a list of secrets that can be used for generating
 // symmetric encryption keys. The most recently generated key is first
 // in the list and the oldest key is last in the list.
+//
+// It also contains a hash key, which is used for calculating a MAC. The hash
+// key is generated once, and is not rotated.
 type secretsT struct {
 	Secrets []*secretT // Most recent first
+	HashKey [32]byte   // All zeros if not generated yet
 }
 
+// marshal encodes the secrets. The hash key is encoded after the list of secrets,
+// so that earlier versions of this package, which only decode the list of secrets,
+// can still read the record.
 func (ss *secretsT) marshal() (format string, data []byte, err error) {
 	var buf bytes.Buffer
 	encoder := gob.NewEncoder(&buf)
 	if err := encoder.Encode(ss.Secrets); err != nil {
 		return "", nil, err
 	}
+	if err := encoder.Encode(ss.HashKey); err != nil {
+		return "", nil, err
+	}
 	return gobFormat, buf.Bytes(), nil
 }
 
@@ -294,7 +465,13 @@ func (ss *secretsT) unmarshal(format string, data []byte) error {
 	if err := decoder.Decode(&secrets); err != nil {
 		return errors.Wrap(err, "cannot unmarshal secret")
 	}
+	var hashKey [32]byte
+	if err := decoder.Decode(&hashKey); err != nil && err != io.EOF {
+		// io.EOF means the record was saved without a hash key
+		return errors.Wrap(err, "cannot unmarshal hash key")
+	}
 	ss.Secrets = secrets
+	ss.HashKey = hashKey
 	return nil
 }
 
@@ -332,44 +509,62 @@ func (ss *secretsT) rotate(now time.Time, rotationPeriod time.Duration, maxAge t
 		keyRequired = ss.Secrets[0].StartAt < before
 	}
 
-	if keyRequired {
-		var keyingMaterial [32]byte
-		if _, err := randReadFunc(keyingMaterial[:]); err != nil {
+	if ss.HashKey == [32]byte{} {
+		if _, err := randReadFunc(ss.HashKey[:]); err != nil {
 			return modified, errors.Wrap(err, "cannot read random bytes")
 		}
+		modified = true
+	}
 
-		startAt := now.Unix()
-
-		if len(ss.Secrets) > 0 {
-			// If a secret already exists, start in the future.
-			// This provides time for other stations to refresh and
-			// receive the new secret.
-			startAt += int64(MinimumRotationPeriod.Seconds())
-		}
-
-		secret := &secretT{
-			KeyingMaterial: keyingMaterial,
-			StartAt:        startAt,
+	if keyRequired {
+		if err := ss.addSecret(now); err != nil {
+			return modified, err
 		}
-
-		// prepend the new secret to the secrets list
-		secrets := make([]*secretT, 0, len(ss.Secrets)+1)
-		secrets = append(secrets, secret)
-		secrets = append(secrets, ss.Secrets...)
-		ss.Secrets = secrets
 		modified = true
 	}
 
 	return modified, nil
 }
 
+// addSecret adds a new secret to the start of the list.
+func (ss *secretsT) addSecret(now time.Time) error {
+	var keyingMaterial [32]byte
+	if _, err := randReadFunc(keyingMaterial[:]); err != nil {
+		return errors.Wrap(err, "cannot read random bytes")
+	}
+
+	startAt := now.Unix()
+
+	if len(ss.Secrets) > 0 {
+		// If a secret already exists, start in the future.
+		// This provides time for other stations to refresh and
+		// receive the new secret.
+		startAt += int64(MinimumRotationPeriod.Seconds())
+	}
+
+	secret := &secretT{
+		KeyingMaterial: keyingMaterial,
+		StartAt:        startAt,
+	}
+
+	// prepend the new secret to the secrets list
+	secrets := make([]*secretT, 0, len(ss.Secrets)+1)
+	secrets = append(secrets, secret)
+	secrets = append(secrets, ss.Secrets...)
+	ss.Secrets = secrets
+	return nil
+}
+
 // immutableCodec is not changed once it is created, and can
 // be called concurrently by different goroutines. It implements
 // the securecookie.Codec interface.
 type immutableCodec struct {
-	encoders  []securecookie.Codec
-	decoders  []securecookie.Codec
-	expiresAt time.Time
+	encoders          []securecookie.Codec
+	decoders          []securecookie.Codec
+	hashKey           [32]byte
+	expiresAt         time.Time
+	rejectUnversioned bool
+	algorithm         Algorithm
 }
 
 // Encode implements the securecookie.Codec interface.
@@ -379,7 +574,72 @@ func (ic *immutableCodec) Encode(name string, value interface{}) (string, error)
 
 // Decode implements the securecookie.Codec interface.
 func (ic *immutableCodec) Decode(name, value string, dst interface{}) error {
-	return securecookie.DecodeMulti(name, value, dst, ic.decoders...)
+	_, err := ic.DecodeWithInfo(name, value, dst)
+	return err
+}
+
+// DecodeWithInfo decodes the value and returns information about the cookie.
+//
+// If the value has a key ID, only the decoder with that key ID is used. Otherwise
+// the value is assumed to have been encoded without a version byte and key ID,
+// and each decoder is tried in turn.
+func (ic *immutableCodec) DecodeWithInfo(name, value string, dst interface{}) (*CookieInfo, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, decodeError("invalid cookie characters")
+	}
+	var errs securecookie.MultiError
+	if alg, keyID, box, ok := parseHeader(sealed, ic.algorithm); ok {
+		for _, decoder := range ic.decoders {
+			cc, ok := decoder.(*cookieCodec)
+			if !ok {
+				// should never happen, as all decoders are cookieCodecs
+				return nil, fmt.Errorf("unexpected decoder type %T", decoder)
+			}
+			if !bytes.Equal(cc.KeyID[:], keyID) {
+				continue
+			}
+			issuedAt, err := cc.open(name, alg, box, dst)
+			if err == nil {
+				return ic.info(decoder, issuedAt), nil
+			}
+			if err != errInvalidCookie {
+				// decrypted, so the value is not in the unversioned format
+				return nil, err
+			}
+			errs = append(errs, err)
+		}
+	}
+	if !ic.rejectUnversioned {
+		for _, decoder := range ic.decoders {
+			cc, ok := decoder.(*cookieCodec)
+			if !ok {
+				return nil, fmt.Errorf("unexpected decoder type %T", decoder)
+			}
+			issuedAt, err := cc.open(name, Secretbox, sealed, dst)
+			if err == nil {
+				return ic.info(decoder, issuedAt), nil
+			}
+			if IsDeserializeError(err) {
+				// decrypted, so the other secrets will not help
+				return nil, err
+			}
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		// no secret with the key ID
+		return nil, errInvalidCookie
+	}
+	return nil, errs
+}
+
+// info returns information about a cookie value decoded by decoder.
+func (ic *immutableCodec) info(decoder securecookie.Codec, issuedAt time.Time) *CookieInfo {
+	return &CookieInfo{
+		IssuedAt: issuedAt,
+		Current:  len(ic.encoders) > 0 && ic.encoders[0] == decoder,
+	}
 }
 
 func (ic *immutableCodec) isExpired() bool {
@@ -393,8 +653,24 @@ type Serializer interface {
 	Deserialize(src []byte, dst interface{}) error
 }
 
-// naclCodec is a codec that encodes/decodes using NaCl secretbox.
-// https://nacl.cr.yp.to/secretbox.html.
+// parseHeader parses the version byte, algorithm ID and key ID of a sealed cookie
+// value, and returns the algorithm, the key ID, and the remainder of the value. It
+// returns false if the value is not in a versioned format, or if the algorithm is
+// not known. The algorithm alg is known, in addition to those in this package.
+func parseHeader(sealed []byte, alg Algorithm) (Algorithm, []byte, []byte, bool) {
+	switch {
+	case len(sealed) > headerLen && sealed[0] == wireVersion:
+		return Secretbox, sealed[1:headerLen], sealed[headerLen:], true
+	case len(sealed) > headerLen+1 && sealed[0] == wireVersionAlgorithm:
+		if alg = algorithmByID(sealed[1], alg); alg != nil {
+			return alg, sealed[2 : headerLen+1], sealed[headerLen+1:], true
+		}
+	}
+	return nil, nil, nil, false
+}
+
+// cookieCodec is a codec that encodes/decodes using an authenticated encryption
+// algorithm, which is NaCl secretbox by default.
 //
 // The reason we use our own encryption/decryption is mainly to have
 // smaller cookies. The securecookie implementation uses AES CTR/HMAC SHA256.
@@ -404,16 +680,20 @@ type Serializer interface {
 // often with small payloads. Using the fast and modern NaCl, which both
 // encrypts and authenticates small messages also has some appeal.
 //
-// This implementation adds an overhead of 64 bytes to the serialized value
-// and base64 encodes one time only.
-type naclCodec struct {
+// The encoded value starts with a version byte and the key ID, so that the decoder
+// does not have to try every secret. With secretbox, this implementation adds an
+// overhead of 69 bytes to the serialized value and base64 encodes one time only.
+type cookieCodec struct {
 	KeyingMaterial [32]byte
+	KeyID          [keyIDLen]byte
+	Algorithm      Algorithm // used for encoding, Secretbox if nil
 	Serializer     Serializer
 	MaxAge         time.Duration
+	CookieMaxAge   map[string]time.Duration // overrides MaxAge, not modified
 }
 
-func (nc *naclCodec) Encode(name string, value interface{}) (string, error) {
-	serializer := nc.Serializer
+func (cc *cookieCodec) Encode(name string, value interface{}) (string, error) {
+	serializer := cc.Serializer
 	if serializer == nil {
 		serializer = defaultSerializer
 	}
@@ -427,62 +707,152 @@ func (nc *naclCodec) Encode(name string, value interface{}) (string, error) {
 	binary.BigEndian.PutUint64(message, uint64(timeNowFunc().Unix()))
 	copy(message[8:], serialized)
 
-	var nonce [24]byte
-	if _, err = randReadFunc(nonce[:]); err != nil {
+	alg := cc.algorithm()
+	aead, err := cc.aead(name, alg)
+	if err != nil {
 		return "", err
 	}
-
-	// Use hkdf to build the key from the keying material and the cookie name.
-	// This prevents cookie swapping without the overhead of including the name
-	// in the clear text.
-	hash := sha256.New
-	kdf := hkdf.New(hash, nc.KeyingMaterial[:], []byte(name), nil)
-	var key [32]byte
-	if _, err = kdf.Read(key[:]); err != nil {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = randReadFunc(nonce); err != nil {
 		return "", err
 	}
-	sealed := secretbox.Seal(nonce[:], message, &nonce, &key)
+
+	header := make([]byte, 0, headerLen+1+len(nonce)+aead.Overhead()+len(message))
+	if alg.ID() == secretboxID {
+		// same format as before other algorithms were supported
+		header = append(header, wireVersion)
+	} else {
+		header = append(header, wireVersionAlgorithm, alg.ID())
+	}
+	header = append(header, cc.KeyID[:]...)
+	sealed := aead.Seal(append(header, nonce...), nonce, message, nil)
 	text := base64.RawURLEncoding.EncodeToString(sealed)
 	return text, nil
 }
 
-func (nc *naclCodec) Decode(name, value string, dst interface{}) error {
+func (cc *cookieCodec) Decode(name, value string, dst interface{}) error {
 	sealed, err := base64.RawURLEncoding.DecodeString(value)
 	if err != nil {
 		return decodeError("invalid cookie characters")
 	}
-	if len(sealed) <= 24+secretbox.Overhead {
-		return decodeError("cookie has been cut")
+	if alg, keyID, box, ok := parseHeader(sealed, cc.Algorithm); ok && bytes.Equal(cc.KeyID[:], keyID) {
+		_, err = cc.open(name, alg, box, dst)
+		if err != errInvalidCookie {
+			return err
+		}
 	}
-	var nonce [24]byte
-	copy(nonce[:], sealed[:24])
-	box := sealed[24:]
-	hash := sha256.New
-	kdf := hkdf.New(hash, nc.KeyingMaterial[:], []byte(name), nil)
-	var key [32]byte
-	if _, err = kdf.Read(key[:]); err != nil {
-		return err
+	_, err = cc.open(name, Secretbox, sealed, dst)
+	return err
+}
+
+func (cc *cookieCodec) algorithm() Algorithm {
+	if cc.Algorithm == nil {
+		return Secretbox
 	}
-	message, ok := secretbox.Open(nil, box, &nonce, &key)
-	if !ok {
-		return decodeError("invalid cookie")
+	return cc.Algorithm
+}
+
+// aead returns the AEAD cipher for the cookie name and algorithm.
+func (cc *cookieCodec) aead(name string, alg Algorithm) (cipher.AEAD, error) {
+	key, err := cc.key(name, alg)
+	if err != nil {
+		return nil, err
+	}
+	return alg.NewAEAD(key)
+}
+
+// key returns the key for the cookie name and algorithm.
+func (cc *cookieCodec) key(name string, alg Algorithm) ([]byte, error) {
+	// Use hkdf to build the key from the keying material and the cookie name.
+	// This prevents cookie swapping without the overhead of including the name
+	// in the clear text. Keys for other algorithms are distinct from secretbox
+	// keys, which are the same as before other algorithms were supported.
+	var info []byte
+	if alg.ID() != secretboxID {
+		info = []byte{alg.ID()}
+	}
+	kdf := hkdf.New(sha256.New, cc.KeyingMaterial[:], []byte(name), info)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// open decrypts the sealed value, which excludes the version byte, algorithm
+// ID and key ID, into dst, and returns the time that the value was encoded. It
+// returns errInvalidCookie if the value cannot be decrypted.
+func (cc *cookieCodec) open(name string, alg Algorithm, sealed []byte, dst interface{}) (time.Time, error) {
+	aead, err := cc.aead(name, alg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nonceSize := aead.NonceSize()
+	if len(sealed) < nonceSize+aead.Overhead()+8 {
+		return time.Time{}, decodeError("cookie has been cut")
+	}
+	message, err := aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return time.Time{}, errInvalidCookie
 	}
 
 	unixTimestamp := int64(binary.BigEndian.Uint64(message))
 	message = message[8:]
 	timestamp := time.Unix(unixTimestamp, 0)
-	maxAge := nc.MaxAge
+	maxAge := cc.CookieMaxAge[name]
+	if maxAge <= 0 {
+		maxAge = cc.MaxAge
+	}
 	if maxAge <= 0 {
 		maxAge = DefaultMaxAge
 	}
 	if timestamp.Add(maxAge).Before(timeNowFunc()) {
-		return decodeError("cookie expired")
+		return time.Time{}, decodeError("cookie expired")
 	}
-	serializer := nc.Serializer
+	serializer := cc.Serializer
 	if serializer == nil {
 		serializer = defaultSerializer
 	}
-	return serializer.Deserialize(message, dst)
+	if err := serializer.Deserialize(message, dst); err != nil {
+		return time.Time{}, &deserializeError{cause: err}
+	}
+	return timestamp, nil
+}
+
+// deserializeError is returned when a cookie value has been decrypted, but
+// cannot be deserialized into the destination value. It implements the
+// securecookie.Error interface.
+type deserializeError struct {
+	cause error
+}
+
+func (e *deserializeError) IsDecode() bool {
+	return true
+}
+
+func (e *deserializeError) IsUsage() bool {
+	return false
+}
+
+func (e *deserializeError) IsInternal() bool {
+	return false
+}
+
+func (e *deserializeError) Cause() error {
+	return e.cause
+}
+
+func (e *deserializeError) Error() string {
+	return e.cause.Error()
+}
+
+// IsDeserializeError reports whether err was returned by Decode or DecodeWithInfo
+// because the cookie value is authentic, but cannot be deserialized into the
+// destination value. This happens when the cookie value was encoded from a value
+// of a different type, for example by a previous version of the program.
+func IsDeserializeError(err error) bool {
+	_, ok := err.(*deserializeError)
+	return ok
 }
 
 // decodeError implements the securecookie.Error interface.
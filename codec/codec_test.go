@@ -1,14 +1,19 @@
 package codec
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
 	mrand "math/rand"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/gorilla/securecookie"
+	"github.com/jjeffery/sessions/storage"
 	"github.com/jjeffery/sessions/storage/memory"
 )
 
@@ -59,7 +64,8 @@ func TestEncodeDecode(t *testing.T) {
 		wantNilError(t, err)
 		cookie, err := codec.Encode("cookie", "some value")
 		wantNilError(t, err)
-		cookies[cookie] = timeNowFunc()
+		// cookie timestamps have a resolution of one second
+		cookies[cookie] = timeNowFunc().Truncate(time.Second)
 		old := timeNowFunc().Add(-time.Hour)
 
 		for c, tm := range cookies {
@@ -223,6 +229,272 @@ func TestExpired(t *testing.T) {
 		wantNilError(t, decode.Cause())
 	}
 }
+
+func TestCookieMaxAge(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+
+	codec := &Codec{
+		DB:     memory.New().WithTimeNow(timeNowFunc),
+		MaxAge: time.Hour,
+		CookieMaxAge: map[string]time.Duration{
+			"oauth":    10 * time.Minute,
+			"remember": 30 * 24 * time.Hour,
+		},
+	}
+	if got, want := codec.MaxAgeFor("session"), time.Hour; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := codec.retention(), 30*24*time.Hour; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	texts := make(map[string]string)
+	for _, name := range []string{"oauth", "session", "remember"} {
+		text, err := codec.Encode(name, "data")
+		wantNilError(t, err)
+		texts[name] = text
+	}
+
+	// decode checks that each cookie is valid until its maximum age
+	decode := func(valid ...string) {
+		t.Helper()
+		for _, name := range []string{"oauth", "session", "remember"} {
+			var value string
+			err := codec.Decode(name, texts[name], &value)
+			want := false
+			for _, v := range valid {
+				want = want || v == name
+			}
+			if got := err == nil; got != want {
+				t.Errorf("%s: got=%v, want=%v", name, err, want)
+			}
+		}
+	}
+
+	fakeNow = fakeNow.Add(10*time.Minute - time.Second)
+	decode("oauth", "session", "remember")
+	fakeNow = fakeNow.Add(2 * time.Second)
+	decode("session", "remember")
+	fakeNow = fakeNow.Add(time.Hour)
+	decode("remember")
+
+	// the secret used for the remember cookie is kept for its maximum age
+	for i := 0; i < 29*24; i++ {
+		fakeNow = fakeNow.Add(time.Hour - time.Second)
+		wantNilError(t, codec.Refresh(context.Background()))
+	}
+	decode("remember")
+	fakeNow = fakeNow.Add(30 * 24 * time.Hour)
+	decode()
+}
+
+func TestDecodeWithInfo(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	codec := &Codec{
+		DB:             memory.New().WithTimeNow(timeNowFunc),
+		MaxAge:         2 * time.Hour,
+		RotationPeriod: time.Hour,
+	}
+
+	text, err := codec.Encode("cookie", "data")
+	wantNilError(t, err)
+	issuedAt := fakeNow
+
+	var value string
+	info, err := codec.DecodeWithInfo("cookie", text, &value)
+	wantNilError(t, err)
+	if got, want := value, "data"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.Current, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.IssuedAt, issuedAt; !got.Equal(want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// authentic value of a different type
+	var number int
+	_, err = codec.DecodeWithInfo("cookie", text, &number)
+	if got, want := IsDeserializeError(err), true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	_, err = codec.DecodeWithInfo("other", text, &value)
+	if got, want := IsDeserializeError(err), false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// new secret is generated, but is not active yet
+	fakeNow = fakeNow.Add(50 * time.Minute)
+	wantNilError(t, codec.Refresh(ctx))
+	info, err = codec.DecodeWithInfo("cookie", text, &value)
+	wantNilError(t, err)
+	if got, want := info.Current, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// new secret is active
+	fakeNow = fakeNow.Add(MinimumRotationPeriod + time.Minute)
+	wantNilError(t, codec.Refresh(ctx))
+	info, err = codec.DecodeWithInfo("cookie", text, &value)
+	wantNilError(t, err)
+	if got, want := info.Current, false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.IssuedAt, issuedAt; !got.Equal(want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	_, err = codec.DecodeWithInfo("cookie", "garbage", &value)
+	wantError(t, err)
+}
+
+func TestWireFormat(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	codec := &Codec{
+		DB:             memory.New().WithTimeNow(timeNowFunc),
+		MaxAge:         8 * time.Hour,
+		RotationPeriod: time.Hour,
+	}
+
+	// encode a cookie with each secret, in both formats
+	var versioned, unversioned []string
+	for i := 0; i < 4; i++ {
+		text, err := codec.Encode("cookie", i)
+		wantNilError(t, err)
+		versioned = append(versioned, text)
+		sealed, err := base64.RawURLEncoding.DecodeString(text)
+		wantNilError(t, err)
+		if got, want := sealed[0], byte(wireVersion); got != want {
+			t.Fatalf("got=%v, want=%v", got, want)
+		}
+		unversioned = append(unversioned, base64.RawURLEncoding.EncodeToString(sealed[headerLen:]))
+
+		// rotate, and wait for the new secret to become active
+		fakeNow = fakeNow.Add(time.Hour)
+		wantNilError(t, codec.Refresh(ctx))
+		fakeNow = fakeNow.Add(MinimumRotationPeriod)
+		wantNilError(t, codec.Refresh(ctx))
+	}
+	decoders := len(codec.codec.decoders)
+	if decoders < 4 {
+		t.Fatalf("got=%v, want=at least 4", decoders)
+	}
+
+	for _, texts := range [][]string{versioned, unversioned} {
+		for i, text := range texts {
+			var value int
+			err := codec.Decode("cookie", text, &value)
+			wantNilError(t, err)
+			if got, want := value, i; got != want {
+				t.Errorf("got=%v, want=%v", got, want)
+			}
+		}
+	}
+
+	// the versioned format only tries the secret with the key ID
+	_, err := codec.DecodeWithInfo("another", versioned[0], new(int))
+	if errs, ok := err.(securecookie.MultiError); !ok || len(errs) != decoders+1 {
+		t.Errorf("got=%v, want=%d errors", err, decoders+1)
+	}
+
+	codec.RejectUnversioned = true
+	codec.codec = nil
+	for i, text := range versioned {
+		var value int
+		err := codec.Decode("cookie", text, &value)
+		wantNilError(t, err)
+		if got, want := value, i; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}
+	for _, text := range unversioned {
+		err := codec.Decode("cookie", text, new(int))
+		wantError(t, err)
+	}
+	_, err = codec.DecodeWithInfo("another", versioned[0], new(int))
+	if errs, ok := err.(securecookie.MultiError); !ok || len(errs) != 1 {
+		t.Errorf("got=%v, want=1 error", err)
+	}
+}
+
+func TestMAC(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	db := memory.New().WithTimeNow(timeNowFunc)
+
+	// secrets record saved before hash keys were introduced
+	{
+		var buf bytes.Buffer
+		secrets := []*secretT{{StartAt: fakeNow.Unix()}}
+		wantNilError(t, gob.NewEncoder(&buf).Encode(secrets))
+		rec := storage.Record{
+			ID:        "secret",
+			Version:   1,
+			Format:    gobFormat,
+			Data:      buf.Bytes(),
+			ExpiresAt: fakeNow.Add(time.Hour),
+		}
+		wantNilError(t, db.Save(ctx, &rec, 0))
+	}
+
+	codec := &Codec{DB: db, MaxAge: time.Hour}
+	mac1, err := codec.MAC(ctx, []byte("message"))
+	wantNilError(t, err)
+	if got, want := len(mac1), sha256.Size; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	mac2, err := codec.MAC(ctx, []byte("another message"))
+	wantNilError(t, err)
+	if bytes.Equal(mac1, mac2) {
+		t.Errorf("want different MACs for different messages")
+	}
+
+	// MAC does not change when secrets are rotated
+	fakeNow = fakeNow.Add(3 * time.Hour)
+	wantNilError(t, codec.Refresh(ctx))
+	mac2, err = codec.MAC(ctx, []byte("message"))
+	wantNilError(t, err)
+	if !bytes.Equal(mac1, mac2) {
+		t.Errorf("got=%x, want=%x", mac2, mac1)
+	}
+
+	// MAC is the same for another codec sharing the secrets record
+	codec = &Codec{DB: db, MaxAge: time.Hour}
+	mac2, err = codec.MAC(ctx, []byte("message"))
+	wantNilError(t, err)
+	if !bytes.Equal(mac1, mac2) {
+		t.Errorf("got=%x, want=%x", mac2, mac1)
+	}
+
+	// secrets record can still be read by code that does not know about hash keys
+	rec, err := db.Fetch(ctx, "secret")
+	wantNilError(t, err)
+	var secrets []*secretT
+	wantNilError(t, gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&secrets))
+	if got, want := len(secrets), 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
 func wantNilError(t *testing.T, err error) {
 	t.Helper()
 	if err != nil {
@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/jjeffery/errors"
+)
+
+// wrappedFormat identifies a secrets record whose gob-encoded secrets have
+// been encrypted by a KeyWrapper.
+const wrappedFormat = "gob+wrapped"
+
+// KeyWrapper encrypts the secret keying material before it is saved to storage,
+// and decrypts it after it is fetched. This is known as envelope encryption: the
+// keying material is only available to processes that can use the wrapping key,
+// rather than to everyone who can read the storage.
+//
+// LocalKeyWrapper uses a master key from a file or environment variable. To use
+// a key management service (KMS), implement KeyWrapper using the KMS client's
+// encrypt and decrypt operations.
+type KeyWrapper interface {
+	// WrapKey encrypts the plaintext keying material.
+	WrapKey(ctx context.Context, plaintext []byte) ([]byte, error)
+
+	// UnwrapKey decrypts keying material encrypted by WrapKey.
+	UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// LocalKeyWrapper is a KeyWrapper that encrypts the keying material using
+// AES-256-GCM with a master key that is available locally.
+type LocalKeyWrapper struct {
+	aead cipher.AEAD
+}
+
+// NewLocalKeyWrapper returns a key wrapper that uses the 32-byte master key.
+func NewLocalKeyWrapper(masterKey []byte) (*LocalKeyWrapper, error) {
+	if len(masterKey) != 32 {
+		return nil, errors.New("master key must be 32 bytes").With("size", len(masterKey))
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalKeyWrapper{aead: aead}, nil
+}
+
+// LocalKeyWrapperFromFile returns a key wrapper that uses the master key in the
+// file. The file contains the base64 encoding of a 32-byte master key.
+func LocalKeyWrapperFromFile(filename string) (*LocalKeyWrapper, error) {
+	errors := errors.With("file", filename)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read master key")
+	}
+	masterKey, err := decodeMasterKey(string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid master key")
+	}
+	return NewLocalKeyWrapper(masterKey)
+}
+
+// LocalKeyWrapperFromEnv returns a key wrapper that uses the master key in the
+// environment variable. The variable contains the base64 encoding of a 32-byte
+// master key.
+func LocalKeyWrapperFromEnv(name string) (*LocalKeyWrapper, error) {
+	errors := errors.With("env", name)
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, errors.New("master key not set")
+	}
+	masterKey, err := decodeMasterKey(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid master key")
+	}
+	return NewLocalKeyWrapper(masterKey)
+}
+
+func decodeMasterKey(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+}
+
+// WrapKey implements the KeyWrapper interface.
+func (w *LocalKeyWrapper) WrapKey(ctx context.Context, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize(), w.aead.NonceSize()+len(plaintext)+w.aead.Overhead())
+	if _, err := randReadFunc(nonce); err != nil {
+		return nil, errors.Wrap(err, "cannot read random bytes")
+	}
+	return w.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// UnwrapKey implements the KeyWrapper interface.
+func (w *LocalKeyWrapper) UnwrapKey(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	nonceSize := w.aead.NonceSize()
+	if len(ciphertext) < nonceSize+w.aead.Overhead() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	plaintext, err := w.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("cannot unwrap key with master key")
+	}
+	return plaintext, nil
+}
+
+// marshalSecrets encodes the secrets, wrapping them if the codec has a key wrapper.
+func (c *Codec) marshalSecrets(ctx context.Context, ss *secretsT) (format string, data []byte, err error) {
+	format, data, err = ss.marshal()
+	if err != nil || c.KeyWrapper == nil {
+		return format, data, err
+	}
+	data, err = c.KeyWrapper.WrapKey(ctx, data)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "cannot wrap secrets")
+	}
+	return wrappedFormat, data, nil
+}
+
+// unmarshalSecrets decodes the secrets, unwrapping them if they have been wrapped.
+// Secrets saved without a key wrapper can be decoded, and are wrapped the next time
+// they are saved.
+func (c *Codec) unmarshalSecrets(ctx context.Context, ss *secretsT, format string, data []byte) error {
+	if format == wrappedFormat {
+		if c.KeyWrapper == nil {
+			return errors.New("secrets are wrapped, but Codec.KeyWrapper is nil")
+		}
+		var err error
+		data, err = c.KeyWrapper.UnwrapKey(ctx, data)
+		if err != nil {
+			return errors.Wrap(err, "cannot unwrap secrets")
+		}
+		format = gobFormat
+	}
+	return ss.unmarshal(format, data)
+}
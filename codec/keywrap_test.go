@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestKeyWrapper(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	db := memory.New().WithTimeNow(timeNowFunc)
+	wrapper, err := NewLocalKeyWrapper(bytes.Repeat([]byte{1}, 32))
+	wantNilError(t, err)
+
+	// secrets saved before the key wrapper was configured
+	codec := &Codec{DB: db, MaxAge: time.Hour}
+	cookie, err := codec.Encode("cookie", "data")
+	wantNilError(t, err)
+
+	// unwrapped secrets can be read, and are wrapped at the next rotation
+	codec = &Codec{DB: db, MaxAge: time.Hour, KeyWrapper: wrapper}
+	var value string
+	wantNilError(t, codec.Decode("cookie", cookie, &value))
+	rec, err := db.Fetch(ctx, "secret")
+	wantNilError(t, err)
+	if got, want := rec.Format, gobFormat; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	fakeNow = fakeNow.Add(50 * time.Minute)
+	wantNilError(t, codec.Refresh(ctx))
+	rec, err = db.Fetch(ctx, "secret")
+	wantNilError(t, err)
+	if got, want := rec.Format, wrappedFormat; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if bytes.Contains(rec.Data, codec.codec.hashKey[:]) {
+		t.Error("got=hash key, want=wrapped secrets")
+	}
+
+	// another codec with the key wrapper can decode cookies
+	codec = &Codec{DB: db, MaxAge: time.Hour, KeyWrapper: wrapper}
+	wantNilError(t, codec.Decode("cookie", cookie, &value))
+	if got, want := value, "data"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// but not without the key wrapper, or with the wrong master key
+	codec = &Codec{DB: db, MaxAge: time.Hour}
+	wantError(t, codec.Refresh(ctx))
+	wrongWrapper, err := NewLocalKeyWrapper(bytes.Repeat([]byte{2}, 32))
+	wantNilError(t, err)
+	codec = &Codec{DB: db, MaxAge: time.Hour, KeyWrapper: wrongWrapper}
+	wantError(t, codec.Refresh(ctx))
+}
+
+func TestLocalKeyWrapperFromEnv(t *testing.T) {
+	const name = "SESSIONS_TEST_MASTER_KEY"
+	defer os.Unsetenv(name)
+	ctx := context.Background()
+
+	_, err := LocalKeyWrapperFromEnv(name)
+	wantError(t, err)
+	os.Setenv(name, "too short")
+	_, err = LocalKeyWrapperFromEnv(name)
+	wantError(t, err)
+
+	os.Setenv(name, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n")
+	w1, err := LocalKeyWrapperFromEnv(name)
+	wantNilError(t, err)
+	wrapped, err := w1.WrapKey(ctx, []byte("keying material"))
+	wantNilError(t, err)
+
+	// the same master key in a file
+	f, err := ioutil.TempFile("", "masterkey")
+	wantNilError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(os.Getenv(name))
+	wantNilError(t, err)
+	wantNilError(t, f.Close())
+	w2, err := LocalKeyWrapperFromFile(f.Name())
+	wantNilError(t, err)
+	plaintext, err := w2.UnwrapKey(ctx, wrapped)
+	wantNilError(t, err)
+	if got, want := string(plaintext), "keying material"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	wrapped[len(wrapped)-1]++
+	_, err = w2.UnwrapKey(ctx, wrapped)
+	wantError(t, err)
+}
@@ -0,0 +1,89 @@
+package codec
+
+import (
+	"context"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+)
+
+// maxUpdateAttempts is the number of times that RotateNow and RevokeAll attempt
+// to save the secrets before giving up because of concurrent updates.
+const maxUpdateAttempts = 5
+
+// RotateNow adds new secret keying material immediately, rather than waiting
+// for the rotation period to pass. As with regular rotation, the new secret is
+// not used for encoding cookies until MinimumRotationPeriod has passed, so that
+// other processes have time to refresh. Existing cookies remain valid.
+func (c *Codec) RotateNow(ctx context.Context) error {
+	return c.updateSecrets(ctx, nil)
+}
+
+// RevokeAll discards all of the secret keying material and replaces it with a new
+// secret, which is used immediately. This invalidates every cookie encoded by the
+// codec, and is intended for use when the secrets may have been compromised.
+//
+// Other processes continue to accept cookies encoded with the revoked secrets until
+// they next refresh, which happens within RefreshInterval. The hash key used by MAC
+// is not changed, so values derived using MAC remain the same.
+func (c *Codec) RevokeAll(ctx context.Context) error {
+	return c.updateSecrets(ctx, func(ss *secretsT) {
+		ss.Secrets = nil
+	})
+}
+
+// updateSecrets fetches the secrets, calls update (if not nil) to modify them,
+// adds a new secret, and saves the secrets using optimistic locking. If another
+// process saves the secrets concurrently, the update is retried.
+func (c *Codec) updateSecrets(ctx context.Context, update func(ss *secretsT)) error {
+	if c.DB == nil {
+		return errors.New("Codec.DB cannot be nil")
+	}
+	secretID := c.secretID()
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		now := timeNowFunc()
+		rec, err := c.DB.Fetch(ctx, secretID)
+		if err != nil {
+			return err
+		}
+		var cb secretsT
+		if rec != nil {
+			if err = c.unmarshalSecrets(ctx, &cb, rec.Format, rec.Data); err != nil {
+				return err
+			}
+		} else {
+			rec = &storage.Record{ID: secretID}
+		}
+		if update != nil {
+			update(&cb)
+		}
+		if err = cb.addSecret(now); err != nil {
+			return err
+		}
+		// removes obsolete secrets, and generates the hash key if necessary
+		if _, err = cb.rotate(now, c.rotationPeriod(), c.retention()); err != nil {
+			return err
+		}
+		oldVersion := rec.Version
+		rec.Version++
+		rec.Format, rec.Data, err = c.marshalSecrets(ctx, &cb)
+		if err != nil {
+			return err
+		}
+		rec.ExpiresAt = now.Add(c.rotationPeriod() * 4)
+		err = c.DB.Save(ctx, rec, oldVersion)
+		if err == storage.ErrVersionConflict {
+			// another process updated the secrets, so try again
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		codec := c.newImmutableCodecFromSecrets(&cb, now)
+		c.mutex.Lock()
+		c.codec = codec
+		c.mutex.Unlock()
+		return nil
+	}
+	return errors.New("cannot update secrets: too many concurrent updates")
+}
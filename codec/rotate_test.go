@@ -0,0 +1,114 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestRotateNow(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	codec := &Codec{DB: memory.New().WithTimeNow(timeNowFunc)}
+	cookie, err := codec.Encode("cookie", "data")
+	wantNilError(t, err)
+
+	wantNilError(t, codec.RotateNow(ctx))
+	wantCodecLength(t, codec.codec.encoders, 1)
+	wantCodecLength(t, codec.codec.decoders, 2)
+	var value string
+	info, err := codec.DecodeWithInfo("cookie", cookie, &value)
+	wantNilError(t, err)
+	if got, want := info.Current, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// the new secret is used once other processes have had time to refresh
+	fakeNow = fakeNow.Add(MinimumRotationPeriod + time.Second)
+	wantNilError(t, codec.Refresh(ctx))
+	wantCodecLength(t, codec.codec.encoders, 2)
+	info, err = codec.DecodeWithInfo("cookie", cookie, &value)
+	wantNilError(t, err)
+	if got, want := info.Current, false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	db := memory.New().WithTimeNow(timeNowFunc)
+	codec := &Codec{DB: db}
+	peer := &Codec{DB: db, RefreshInterval: time.Minute}
+	cookie, err := codec.Encode("cookie", "data")
+	wantNilError(t, err)
+	var value string
+	wantNilError(t, peer.Decode("cookie", cookie, &value))
+	mac1, err := codec.MAC(ctx, []byte("message"))
+	wantNilError(t, err)
+
+	wantNilError(t, codec.RevokeAll(ctx))
+	wantCodecLength(t, codec.codec.encoders, 1)
+	wantCodecLength(t, codec.codec.decoders, 1)
+	wantError(t, codec.Decode("cookie", cookie, &value))
+	newCookie, err := codec.Encode("cookie", "data")
+	wantNilError(t, err)
+
+	// the peer accepts revoked cookies until it refreshes
+	wantNilError(t, peer.Decode("cookie", cookie, &value))
+	fakeNow = fakeNow.Add(time.Minute + time.Second)
+	wantError(t, peer.Decode("cookie", cookie, &value))
+	wantNilError(t, peer.Decode("cookie", newCookie, &value))
+
+	// the hash key is not revoked
+	mac2, err := peer.MAC(ctx, []byte("message"))
+	wantNilError(t, err)
+	if !bytes.Equal(mac1, mac2) {
+		t.Errorf("got=%x, want=%x", mac2, mac1)
+	}
+}
+
+// racingProvider saves the secrets using another codec the first time the
+// secrets are fetched, causing a version conflict.
+type racingProvider struct {
+	storage.Provider
+	other *Codec
+}
+
+func (p *racingProvider) Fetch(ctx context.Context, id string) (*storage.Record, error) {
+	rec, err := p.Provider.Fetch(ctx, id)
+	if other := p.other; other != nil {
+		p.other = nil
+		if err := other.RotateNow(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return rec, err
+}
+
+func TestRotateNowConflict(t *testing.T) {
+	defer restoreStubs()
+	var fakeNow = time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeNowFunc = func() time.Time {
+		return fakeNow
+	}
+	ctx := context.Background()
+	db := memory.New().WithTimeNow(timeNowFunc)
+	wantNilError(t, (&Codec{DB: db}).Refresh(ctx))
+
+	codec := &Codec{DB: &racingProvider{Provider: db, other: &Codec{DB: db}}}
+	wantNilError(t, codec.RotateNow(ctx))
+	wantCodecLength(t, codec.codec.decoders, 3)
+}
@@ -14,6 +14,22 @@ import (
 func TestStorageProvider(t *testing.T, db storage.Provider) {
 	conflictTest(t, db)
 	raceTest(t, db)
+	metadataTest(t, db)
+	if lister, ok := db.(storage.Lister); ok {
+		listTest(t, db, lister)
+	}
+	if purger, ok := db.(storage.Purger); ok {
+		purgeTest(t, db, purger)
+	}
+	if toucher, ok := db.(storage.Toucher); ok {
+		touchTest(t, db, toucher)
+	}
+	if upgrader, ok := db.(storage.Upgrader); ok {
+		upgradeTest(t, db, upgrader)
+	}
+	if indexer, ok := db.(storage.Indexer); ok {
+		indexTest(t, db, indexer)
+	}
 }
 
 func conflictTest(t *testing.T, db storage.Provider) {
@@ -179,3 +195,358 @@ func raceTest2(t *testing.T, db storage.Provider, instance int, add bool) {
 		}
 	}
 }
+
+func listTest(t *testing.T, db storage.Provider, lister storage.Lister) {
+	ctx := context.Background()
+	const count = 25
+	var ids []string
+	for i := 0; i < count; i++ {
+		ids = append(ids, fmt.Sprintf("list-test-a-%02d", i))
+	}
+	// records that should not be listed
+	ids = append(ids, "list-test-b-00", "list-test-aa-00")
+	for _, id := range ids {
+		rec := storage.Record{
+			ID:        id,
+			Format:    "test",
+			ExpiresAt: time.Now().Add(12 * time.Hour),
+			Data:      []byte(id),
+		}
+		if err := db.Save(ctx, &rec, -1); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		defer db.Delete(ctx, id)
+	}
+
+	listIDs := func(prefix string, pageSize int) map[string]bool {
+		t.Helper()
+		m := make(map[string]bool)
+		iter := lister.List(ctx, prefix, pageSize)
+		for iter.Next() {
+			rec := iter.Record()
+			if m[rec.ID] {
+				t.Errorf("%s: listed more than once", rec.ID)
+			}
+			if got, want := string(rec.Data), rec.ID; got != want {
+				t.Errorf("got=%v, want=%v", got, want)
+			}
+			m[rec.ID] = true
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		return m
+	}
+
+	for _, pageSize := range []int{0, 1, 7, count, count + 1} {
+		m := listIDs("list-test-a-", pageSize)
+		if got, want := len(m), count; got != want {
+			t.Errorf("pageSize=%d: got=%v, want=%v", pageSize, got, want)
+		}
+		for i := 0; i < count; i++ {
+			if id := ids[i]; !m[id] {
+				t.Errorf("pageSize=%d: missing %s", pageSize, id)
+			}
+		}
+	}
+
+	// characters with special meaning to the database should not match
+	for _, prefix := range []string{"list_test", "list%test", "list-test-c"} {
+		if got, want := len(listIDs(prefix, 0)), 0; got != want {
+			t.Errorf("prefix=%s: got=%v, want=%v", prefix, got, want)
+		}
+	}
+
+	// canceled context
+	{
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		iter := lister.List(ctx, "list-test-a-", 0)
+		if iter.Next() {
+			t.Errorf("got=true, want=false")
+		}
+		if got, want := iter.Err(), context.Canceled; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}
+}
+
+func purgeTest(t *testing.T, db storage.Provider, purger storage.Purger) {
+	ctx := context.Background()
+	ids := []string{"purge-test-1", "purge-test-2", "purge-test-3", "purge-test-live"}
+	for _, id := range ids {
+		rec := storage.Record{
+			ID:        id,
+			Format:    "test",
+			ExpiresAt: time.Now().Add(-time.Hour),
+			Data:      []byte(id),
+		}
+		if id == "purge-test-live" {
+			rec.ExpiresAt = time.Now().Add(time.Hour)
+		}
+		if err := db.Save(ctx, &rec, -1); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		defer db.Delete(ctx, id)
+	}
+
+	for _, tt := range []struct {
+		limit int
+		want  int
+	}{
+		{limit: 2, want: 2},
+		{limit: 0, want: 1},
+		{limit: 0, want: 0},
+	} {
+		count, err := purger.PurgeN(ctx, tt.limit)
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if got, want := count, tt.want; got != want {
+			t.Fatalf("limit=%d: got=%v, want=%v", tt.limit, got, want)
+		}
+	}
+
+	rec, err := db.Fetch(ctx, "purge-test-live")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec == nil {
+		t.Fatal("got=nil, want=non-nil")
+	}
+}
+
+func upgradeTest(t *testing.T, db storage.Provider, upgrader storage.Upgrader) {
+	ctx := context.Background()
+	const id = "upgrade-test-id"
+	defer db.Delete(ctx, id)
+
+	rec := storage.Record{
+		ID:        id,
+		Version:   1,
+		Format:    "test",
+		Data:      []byte("unversioned"),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if got, want := upgrader.Upgrade(ctx, &rec), storage.ErrVersionConflict; got != want {
+		t.Fatalf("missing: got=%v, want=%v", got, want)
+	}
+	if err := db.Save(ctx, &rec, -1); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	fetched, err := db.Fetch(ctx, id)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := fetched.Version, int64(0); got != want {
+		t.Fatalf("unversioned: got=%v, want=%v", got, want)
+	}
+	if got, want := db.Save(ctx, &rec, 1), storage.ErrVersionConflict; got != want {
+		t.Fatalf("unversioned: got=%v, want=%v", got, want)
+	}
+
+	rec.Data = []byte("versioned")
+	if err := upgrader.Upgrade(ctx, &rec); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := upgrader.Upgrade(ctx, &rec), storage.ErrVersionConflict; got != want {
+		t.Fatalf("versioned: got=%v, want=%v", got, want)
+	}
+	fetched, err = db.Fetch(ctx, id)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := fetched.Version, int64(1); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := string(fetched.Data), "versioned"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	rec.Version = 2
+	if err := db.Save(ctx, &rec, 1); err != nil {
+		t.Errorf("got=%v, want=nil", err)
+	}
+}
+
+func metadataTest(t *testing.T, db storage.Provider) {
+	ctx := context.Background()
+	const id = "metadata-test-id"
+	defer db.Delete(ctx, id)
+
+	now := time.Now()
+	for _, version := range []int64{-1, 0} {
+		saveRec := storage.Record{
+			ID:         id,
+			Version:    1,
+			Format:     "test",
+			Data:       []byte(id),
+			CreatedAt:  now.Add(-time.Hour),
+			LastSeenAt: now.Add(-time.Minute),
+			ExpiresAt:  now.Add(time.Hour),
+			ClientIP:   "2001:db8::1",
+			UserAgent:  "Mozilla/5.0",
+		}
+		if err := db.Delete(ctx, id); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if err := db.Save(ctx, &saveRec, version); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		rec, err := db.Fetch(ctx, id)
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if rec == nil {
+			t.Fatal("got=nil, want=non-nil")
+		}
+		if got, want := rec.CreatedAt.Unix(), saveRec.CreatedAt.Unix(); got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+		if got, want := rec.LastSeenAt.Unix(), saveRec.LastSeenAt.Unix(); got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+		if got, want := rec.ClientIP, saveRec.ClientIP; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+		if got, want := rec.UserAgent, saveRec.UserAgent; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}
+}
+
+func touchTest(t *testing.T, db storage.Provider, toucher storage.Toucher) {
+	ctx := context.Background()
+	const id = "touch-test-id"
+	defer db.Delete(ctx, id)
+
+	now := time.Now()
+	saveRec := storage.Record{
+		ID:        id,
+		Version:   1,
+		Format:    "test",
+		Data:      []byte(id),
+		CreatedAt: now.Add(-time.Minute),
+		ExpiresAt: now.Add(time.Hour),
+		ClientIP:  "192.0.2.1",
+	}
+	if err := db.Save(ctx, &saveRec, 0); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	expiresAt := now.Add(2 * time.Hour)
+	if err := toucher.Touch(ctx, id, expiresAt, now); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	rec, err := db.Fetch(ctx, id)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec == nil {
+		t.Fatal("got=nil, want=non-nil")
+	}
+	if got, want := rec.ExpiresAt.Unix(), expiresAt.Unix(); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := rec.CreatedAt.Unix(), saveRec.CreatedAt.Unix(); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := rec.LastSeenAt.Unix(), now.Unix(); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := rec.ClientIP, saveRec.ClientIP; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := rec.Version, saveRec.Version; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := string(rec.Data), id; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// touching a record that does not exist does not create it
+	const missingID = "touch-test-missing-id"
+	if err := toucher.Touch(ctx, missingID, expiresAt, now); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	rec, err = db.Fetch(ctx, missingID)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec != nil {
+		t.Fatalf("got=%v, want=nil", rec)
+	}
+}
+
+func indexTest(t *testing.T, db storage.Provider, indexer storage.Indexer) {
+	ctx := context.Background()
+	const count = 12
+	const key = "index-test-key"
+	var ids []string
+	for i := 0; i < count; i++ {
+		ids = append(ids, fmt.Sprintf("index-test-%02d", i))
+	}
+	for i, id := range append(ids, "index-test-other", "index-test-none") {
+		rec := storage.Record{
+			ID:        id,
+			Format:    "test",
+			ExpiresAt: time.Now().Add(12 * time.Hour),
+			Data:      []byte(id),
+		}
+		switch {
+		case i < count:
+			rec.IndexKey = key
+		case id == "index-test-other":
+			rec.IndexKey = key + "-other"
+		}
+		if err := db.Save(ctx, &rec, -1); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		defer db.Delete(ctx, id)
+	}
+
+	for _, pageSize := range []int{0, 1, 5, count, count + 1} {
+		m := make(map[string]bool)
+		iter := indexer.ListIndexed(ctx, key, pageSize)
+		for iter.Next() {
+			rec := iter.Record()
+			if m[rec.ID] {
+				t.Errorf("%s: listed more than once", rec.ID)
+			}
+			if got, want := rec.IndexKey, key; got != want {
+				t.Errorf("got=%v, want=%v", got, want)
+			}
+			m[rec.ID] = true
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if got, want := len(m), count; got != want {
+			t.Errorf("pageSize=%d: got=%v, want=%v", pageSize, got, want)
+		}
+		for _, id := range ids {
+			if !m[id] {
+				t.Errorf("pageSize=%d: missing %s", pageSize, id)
+			}
+		}
+	}
+
+	// removing the index key removes the record from the index
+	rec := storage.Record{
+		ID:        ids[0],
+		Format:    "test",
+		ExpiresAt: time.Now().Add(12 * time.Hour),
+		Data:      []byte(ids[0]),
+	}
+	if err := db.Save(ctx, &rec, -1); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	iter := indexer.ListIndexed(ctx, key, 0)
+	for iter.Next() {
+		if got, notWant := iter.Record().ID, ids[0]; got == notWant {
+			t.Errorf("got=%v, want other", got)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+}
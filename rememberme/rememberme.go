@@ -0,0 +1,437 @@
+// Package rememberme provides persistent login cookies, which keep a user logged in
+// after their session has expired.
+//
+// Each persistent login is a series, which is created when the user logs in and
+// asks to be remembered. The remember-me cookie contains the series identifier and
+// a random token. Each time the cookie is used to log the user in, the token is
+// replaced, and the client is sent a new cookie. Only a hash of the current token
+// is persisted.
+//
+// If a cookie is presented with a token that has already been replaced, then the
+// cookie has been copied, and either the attacker or the user has already used it.
+// This is treated as theft: the series is deleted, along with every session that
+// was established using it, so that both the user and the attacker are logged out.
+//
+// Package sessionstore re-establishes expired sessions automatically using the
+// remember-me cookie. See the RememberMe field of sessionstore.Store.
+package rememberme
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/codec"
+	"github.com/jjeffery/sessions/session"
+	"github.com/jjeffery/sessions/storage"
+)
+
+const (
+	// seriesFormat is the record format used for a persistent login series.
+	seriesFormat = "remember-series"
+
+	// defaultName is the cookie name used if the manager does not have a name.
+	defaultName = "remember"
+
+	// defaultMaxAge is the lifetime of a series if the manager does not have a max age.
+	defaultMaxAge = 30 * 24 * time.Hour
+
+	// defaultGracePeriod is the grace period if the manager does not have one.
+	defaultGracePeriod = time.Minute
+
+	// maxSeriesSessions is the maximum number of sessions remembered for each
+	// series. Only the most recent sessions are remembered, and older sessions
+	// will usually have expired.
+	maxSeriesSessions = 20
+
+	// maxSaveAttempts is the number of times that a session is added to a series
+	// when there are concurrent updates to the series.
+	maxSaveAttempts = 5
+)
+
+var (
+	// nowFunc returns the current time. It can be replaced for testing.
+	nowFunc = time.Now
+)
+
+// Manager issues and checks remember-me cookies.
+//
+// The remember-me cookies are encrypted using Codec, which should not be shared with
+// the session manager, as the remember-me cookies have a much longer lifetime than
+// session cookies. The codec's MaxAge should be at least MaxAge. The series records
+// are persisted using DB.
+//
+// If Sessions is set, the sessions established using each series are recorded, so
+// that they can be revoked if theft is detected.
+//
+// After a token has been replaced, the old token is still accepted for GracePeriod,
+// without being replaced again. This allows for concurrent requests that present
+// the same cookie.
+//
+// While all fields are public, they should not be modified once the manager is in use.
+type Manager struct {
+	DB       storage.Provider
+	Codec    *codec.Codec
+	Sessions *session.Manager // revokes sessions of stolen series if not nil
+	AppID    string           // set if multiple apps share the same storage provider
+	Name     string           // cookie name, "remember" if empty
+
+	MaxAge      time.Duration // lifetime of an unused series, 30 days if zero
+	GracePeriod time.Duration // replaced tokens remain valid, one minute if zero
+
+	// UserIDKey is the session value key that sessionstore.Store uses for the
+	// user ID when it re-establishes a session. If empty, the user ID is not saved
+	// in the session values.
+	UserIDKey string
+}
+
+// New creates a new manager that persists series records using db. The appid
+// should be the same as the application ID of the session manager. Sessions
+// established using remember-me cookies are revoked using sessions if theft is
+// detected.
+func New(db storage.Provider, sessions *session.Manager, appid string) *Manager {
+	return &Manager{
+		DB:        db,
+		Sessions:  sessions,
+		AppID:     appid,
+		UserIDKey: "user_id",
+		Codec: &codec.Codec{
+			DB:       db,
+			MaxAge:   defaultMaxAge,
+			SecretID: appid + "_remember_secrets",
+		},
+	}
+}
+
+// Login is a successful check of a remember-me cookie.
+type Login struct {
+	UserID string // user who is remembered
+	Series string // series identifier
+
+	rec    *storage.Record
+	series *seriesRecord
+	stale  bool // token has already been replaced by a concurrent request
+}
+
+// TheftError is the error returned by Check when a remember-me cookie is presented
+// with a token that has already been replaced. The series has been deleted.
+type TheftError struct {
+	UserID string
+	Series string
+}
+
+// Error implements the error interface.
+func (e *TheftError) Error() string {
+	return "remember-me token reused, series revoked: " + e.Series
+}
+
+// seriesRecord is the persistent form of a series.
+type seriesRecord struct {
+	UserID     string
+	TokenHash  [32]byte
+	PrevHash   [32]byte  // hash of the token that was replaced
+	ReplacedAt time.Time // time the previous token was replaced
+	Sessions   []string  // keys of sessions established, see session.Manager.SessionKey
+}
+
+// cookieValue is the content of the remember-me cookie.
+type cookieValue struct {
+	Series [16]byte
+	Token  [32]byte
+}
+
+// CookieName returns the name of the remember-me cookie.
+func (m *Manager) CookieName() string {
+	if m.Name == "" {
+		return defaultName
+	}
+	return m.Name
+}
+
+// CookieMaxAge returns the max age of the remember-me cookie, which is the
+// lifetime of an unused series.
+func (m *Manager) CookieMaxAge() time.Duration {
+	if m.MaxAge <= 0 {
+		return defaultMaxAge
+	}
+	return m.MaxAge
+}
+
+// Issue creates a new series for the user identified by userID, and returns the
+// value of the remember-me cookie to send to the client. If sid is not empty, it
+// is the ID of the session that the user has logged in with, which is revoked
+// along with the others if theft is detected.
+func (m *Manager) Issue(ctx context.Context, userID string, sid string) (string, error) {
+	errors := errors.With("user", userID)
+	if userID == "" {
+		return "", errors.New("empty user id")
+	}
+	var cv cookieValue
+	if _, err := rand.Read(cv.Series[:]); err != nil {
+		return "", errors.Wrap(err, "cannot generate random series id")
+	}
+	if _, err := rand.Read(cv.Token[:]); err != nil {
+		return "", errors.Wrap(err, "cannot generate random token")
+	}
+	series := seriesRecord{
+		UserID:    userID,
+		TokenHash: sha256.Sum256(cv.Token[:]),
+	}
+	if err := m.addSession(ctx, &series, sid); err != nil {
+		return "", err
+	}
+	now := nowFunc()
+	rec := storage.Record{
+		ID:        m.seriesRecordID(cv.Series),
+		Version:   1,
+		Format:    seriesFormat,
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.CookieMaxAge()),
+	}
+	if err := m.saveSeries(ctx, &rec, &series, 0); err != nil {
+		return "", errors.Wrap(err, "cannot save series")
+	}
+	return m.encodeCookie(ctx, &cv)
+}
+
+// Check checks the remember-me cookie value, and returns the login if the cookie
+// is valid. It returns nil if the cookie cannot be decoded, or if its series has
+// expired or been deleted. If the cookie's token has already been replaced, then
+// the series is deleted, along with the sessions established using it, and Check
+// returns a *TheftError.
+//
+// Check does not replace the token: call Rotate once the client can be sent
+// a new cookie.
+func (m *Manager) Check(ctx context.Context, value string) (*Login, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if err := m.Codec.Refresh(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot refresh codec")
+	}
+	var cv cookieValue
+	if err := m.Codec.Decode(m.CookieName(), value, &cv); err != nil {
+		// treat an invalid cookie as if it were not there
+		return nil, nil
+	}
+	seriesID := hex.EncodeToString(cv.Series[:])
+	errors := errors.With("series", seriesID)
+	rec, err := m.DB.Fetch(ctx, m.seriesRecordID(cv.Series))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch series")
+	}
+	now := nowFunc()
+	if rec == nil || rec.Format != seriesFormat || !rec.ExpiresAt.After(now) {
+		return nil, nil
+	}
+	series, err := decodeSeries(rec)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode series")
+	}
+	login := &Login{
+		UserID: series.UserID,
+		Series: seriesID,
+		rec:    rec,
+		series: series,
+	}
+	hash := sha256.Sum256(cv.Token[:])
+	if subtle.ConstantTimeCompare(hash[:], series.TokenHash[:]) == 1 {
+		return login, nil
+	}
+	if subtle.ConstantTimeCompare(hash[:], series.PrevHash[:]) == 1 &&
+		now.Before(series.ReplacedAt.Add(m.gracePeriod())) {
+		login.stale = true
+		return login, nil
+	}
+
+	// The token has been replaced, so the cookie has been stolen.
+	if err := m.revoke(ctx, rec.ID, series); err != nil {
+		return nil, err
+	}
+	return nil, &TheftError{UserID: series.UserID, Series: seriesID}
+}
+
+// Rotate replaces the token of the login's series, and returns the new value of
+// the remember-me cookie to send to the client. If sid is not empty, it is the
+// ID of the session established using the login.
+//
+// Rotate returns an empty cookie value if the token has already been replaced by
+// a concurrent request, in which case the client will receive the new cookie value
+// in the response to that request. The session is still recorded in the series.
+func (m *Manager) Rotate(ctx context.Context, login *Login, sid string) (string, error) {
+	if login.stale {
+		return "", m.recordSession(ctx, login, sid)
+	}
+	errors := errors.With("series", login.Series)
+	var cv cookieValue
+	if _, err := hex.Decode(cv.Series[:], []byte(login.Series)); err != nil {
+		return "", errors.Wrap(err, "invalid series")
+	}
+	if _, err := rand.Read(cv.Token[:]); err != nil {
+		return "", errors.Wrap(err, "cannot generate random token")
+	}
+	now := nowFunc()
+	series := *login.series
+	series.PrevHash = series.TokenHash
+	series.TokenHash = sha256.Sum256(cv.Token[:])
+	series.ReplacedAt = now
+	if err := m.addSession(ctx, &series, sid); err != nil {
+		return "", err
+	}
+	rec := *login.rec
+	rec.Version = login.rec.Version + 1
+	rec.ExpiresAt = now.Add(m.CookieMaxAge())
+	if err := m.saveSeries(ctx, &rec, &series, login.rec.Version); err != nil {
+		if err == storage.ErrVersionConflict {
+			// replaced by a concurrent request
+			return "", m.recordSession(ctx, login, sid)
+		}
+		return "", errors.Wrap(err, "cannot save series")
+	}
+	login.rec = &rec
+	login.series = &series
+	return m.encodeCookie(ctx, &cv)
+}
+
+// Forget deletes the series of the remember-me cookie value, so that it can no
+// longer be used. It should be called when the user logs out.
+func (m *Manager) Forget(ctx context.Context, value string) error {
+	if value == "" {
+		return nil
+	}
+	if err := m.Codec.Refresh(ctx); err != nil {
+		return errors.Wrap(err, "cannot refresh codec")
+	}
+	var cv cookieValue
+	if err := m.Codec.Decode(m.CookieName(), value, &cv); err != nil {
+		return nil
+	}
+	if err := m.DB.Delete(ctx, m.seriesRecordID(cv.Series)); err != nil {
+		return errors.Wrap(err, "cannot delete series")
+	}
+	return nil
+}
+
+// revoke deletes the series record with ID id, and every session established
+// using the series.
+func (m *Manager) revoke(ctx context.Context, id string, series *seriesRecord) error {
+	if err := m.DB.Delete(ctx, id); err != nil {
+		return errors.Wrap(err, "cannot delete series").With("user", series.UserID)
+	}
+	if m.Sessions == nil {
+		return nil
+	}
+	for _, key := range series.Sessions {
+		if err := m.Sessions.RevokeSession(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordSession adds the session with ID sid to the sessions established by the
+// login's series, without replacing the token. If the series has been updated by
+// a concurrent request, it is fetched again and the update is retried. Nothing is
+// recorded if the series has been deleted in the meantime.
+func (m *Manager) recordSession(ctx context.Context, login *Login, sid string) error {
+	if sid == "" || m.Sessions == nil {
+		return nil
+	}
+	errors := errors.With("series", login.Series)
+	rec, series := login.rec, login.series
+	for attempt := 0; attempt < maxSaveAttempts; attempt++ {
+		updated := *series
+		if err := m.addSession(ctx, &updated, sid); err != nil {
+			return err
+		}
+		newRec := *rec
+		newRec.Version = rec.Version + 1
+		err := m.saveSeries(ctx, &newRec, &updated, rec.Version)
+		if err == nil {
+			login.rec = &newRec
+			login.series = &updated
+			return nil
+		}
+		if err != storage.ErrVersionConflict {
+			return errors.Wrap(err, "cannot save series")
+		}
+		if rec, err = m.DB.Fetch(ctx, rec.ID); err != nil {
+			return errors.Wrap(err, "cannot fetch series")
+		}
+		if rec == nil || rec.Format != seriesFormat {
+			return nil
+		}
+		if series, err = decodeSeries(rec); err != nil {
+			return errors.Wrap(err, "cannot decode series")
+		}
+	}
+	return errors.New("cannot save series: too many concurrent updates")
+}
+
+// addSession adds the session with ID sid to the sessions established by the series.
+func (m *Manager) addSession(ctx context.Context, series *seriesRecord, sid string) error {
+	if sid == "" || m.Sessions == nil {
+		return nil
+	}
+	key, err := m.Sessions.SessionKey(ctx, sid)
+	if err != nil {
+		return err
+	}
+	sessions := append([]string(nil), series.Sessions...)
+	sessions = append(sessions, key)
+	if len(sessions) > maxSeriesSessions {
+		sessions = sessions[len(sessions)-maxSeriesSessions:]
+	}
+	series.Sessions = sessions
+	return nil
+}
+
+// saveSeries saves the series record, checking for version conflicts.
+func (m *Manager) saveSeries(ctx context.Context, rec *storage.Record, series *seriesRecord, oldVersion int64) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(series); err != nil {
+		return err
+	}
+	rec.Data = buf.Bytes()
+	return m.DB.Save(ctx, rec, oldVersion)
+}
+
+// decodeSeries decodes the series record.
+func decodeSeries(rec *storage.Record) (*seriesRecord, error) {
+	var series seriesRecord
+	if err := gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&series); err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+// encodeCookie encodes the remember-me cookie value.
+func (m *Manager) encodeCookie(ctx context.Context, cv *cookieValue) (string, error) {
+	if err := m.Codec.Refresh(ctx); err != nil {
+		return "", errors.Wrap(err, "cannot refresh codec")
+	}
+	return m.Codec.Encode(m.CookieName(), cv)
+}
+
+// gracePeriod returns the time that a replaced token remains valid.
+func (m *Manager) gracePeriod() time.Duration {
+	if m.GracePeriod <= 0 {
+		return defaultGracePeriod
+	}
+	return m.GracePeriod
+}
+
+// seriesRecordID returns the record ID for the series.
+func (m *Manager) seriesRecordID(series [16]byte) string {
+	id := "remember-" + hex.EncodeToString(series[:])
+	if m.AppID == "" {
+		return id
+	}
+	return m.AppID + "-" + id
+}
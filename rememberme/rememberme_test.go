@@ -0,0 +1,176 @@
+package rememberme
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/session"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestRememberMe(t *testing.T) {
+	defer func() { nowFunc = time.Now }()
+	ctx := context.Background()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	db := memory.New()
+	sessions := session.New(db, "app")
+	m := New(db, sessions, "app")
+
+	// newSession saves a new session and returns its ID
+	newSession := func() string {
+		t.Helper()
+		s := sessions.NewSession()
+		s.Values["key"] = "value"
+		if _, err := s.Commit(ctx); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		return s.ID
+	}
+	// sessionExists reports whether the session with ID sid exists
+	sessionExists := func(sid string) bool {
+		t.Helper()
+		info, err := sessions.LookupSession(ctx, sid)
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		return info != nil
+	}
+
+	sid1 := newSession()
+	cookie1, err := m.Issue(ctx, "alice", sid1)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	login, err := m.Check(ctx, cookie1)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if login == nil {
+		t.Fatal("got=nil, want=login")
+	}
+	if got, want := login.UserID, "alice"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	sid2 := newSession()
+	cookie2, err := m.Rotate(ctx, login, sid2)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if cookie2 == "" {
+		t.Fatal("got=empty, want=cookie")
+	}
+
+	// the replaced token is accepted during the grace period, but is not replaced
+	// again, and the session established with it is still recorded
+	login, err = m.Check(ctx, cookie1)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if login == nil {
+		t.Fatal("got=nil, want=login")
+	}
+	sid3 := newSession()
+	if got, err := m.Rotate(ctx, login, sid3); err != nil || got != "" {
+		t.Fatalf("got=%q, %v, want=empty, nil", got, err)
+	}
+
+	// the replaced token is theft after the grace period
+	fakeNow = fakeNow.Add(2 * time.Minute)
+	login, err = m.Check(ctx, cookie1)
+	if _, ok := err.(*TheftError); !ok {
+		t.Fatalf("got=%v, want=*TheftError", err)
+	}
+	if login != nil {
+		t.Errorf("got=%v, want=nil", login)
+	}
+	for _, sid := range []string{sid1, sid2, sid3} {
+		if sessionExists(sid) {
+			t.Errorf("got=exists, want=revoked")
+		}
+	}
+
+	// the series has been deleted, so the current token no longer works
+	login, err = m.Check(ctx, cookie2)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if login != nil {
+		t.Errorf("got=%v, want=nil", login)
+	}
+}
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	m := New(memory.New(), nil, "app")
+	cookie, err := m.Issue(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if err := m.Forget(ctx, cookie); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	login, err := m.Check(ctx, cookie)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if login != nil {
+		t.Errorf("got=%v, want=nil", login)
+	}
+
+	// invalid cookies are ignored
+	if login, err := m.Check(ctx, "garbage"); login != nil || err != nil {
+		t.Errorf("got=%v, %v, want=nil, nil", login, err)
+	}
+}
+
+func TestRotateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	sessions := session.New(db, "app")
+	m := New(db, sessions, "app")
+	cookie, err := m.Issue(ctx, "alice", "")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	// two requests present the same cookie before either replaces the token
+	var sids []string
+	var logins []*Login
+	for i := 0; i < 2; i++ {
+		s := sessions.NewSession()
+		s.Values["key"] = "value"
+		if _, err := s.Commit(ctx); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		sids = append(sids, s.ID)
+		login, err := m.Check(ctx, cookie)
+		if err != nil || login == nil {
+			t.Fatalf("got=%v, %v, want=login, nil", login, err)
+		}
+		logins = append(logins, login)
+	}
+	if got, err := m.Rotate(ctx, logins[0], sids[0]); err != nil || got == "" {
+		t.Fatalf("got=%q, %v, want=cookie, nil", got, err)
+	}
+	if got, err := m.Rotate(ctx, logins[1], sids[1]); err != nil || got != "" {
+		t.Fatalf("got=%q, %v, want=empty, nil", got, err)
+	}
+
+	// both sessions are revoked when theft is detected
+	if err := m.revoke(ctx, logins[1].rec.ID, logins[1].series); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	for _, sid := range sids {
+		info, err := sessions.LookupSession(ctx, sid)
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if info != nil {
+			t.Errorf("got=exists, want=revoked")
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/codec"
+)
+
+// cookiePayload is the content of the session cookie. Every session cookie has
+// the same payload type, so that the cookie value is decoded once. The kind of
+// payload determines whether the session values are kept in the cookie, or in
+// a session record.
+type cookiePayload struct {
+	Kind        payloadKind
+	ID          sessionID
+	Fingerprint fingerprint // zero if the client has not been fingerprinted
+	Bound       bool        // session is bound to a user, only if kept in a session record
+	CreatedAt   int64       // unix time, only if the values are in the cookie
+	ExpiresAt   int64       // unix time, only if the values are in the cookie
+	Format      string      // serialization format of Data
+	Data        []byte      // serialized session values
+
+	legacy bool // decoded from a cookie that contains only the session ID
+}
+
+// payloadKind identifies the kind of cookie payload.
+type payloadKind byte
+
+// Kinds of cookie payload.
+const (
+	payloadID     payloadKind = iota // session ID of a session kept in a session record
+	payloadValues                    // session ID and values of a session kept in the cookie
+)
+
+// The first byte of a binary encoded cookie payload is its version, which is
+// followed by a flags byte, the session ID, the client fingerprint if it is not
+// zero, and the session values if they are in the cookie.
+const cookiePayloadVersion = 1
+
+// Flags in a cookie payload.
+const (
+	payloadFlagValues      byte = 1 << 0
+	payloadFlagFingerprint byte = 1 << 1
+	payloadFlagBound       byte = 1 << 2
+)
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface. A compact binary
+// encoding is used, because cookie size is limited.
+func (p *cookiePayload) MarshalBinary() ([]byte, error) {
+	if len(p.Format) > 255 {
+		return nil, errors.New("format name too long").With("format", p.Format)
+	}
+	data := make([]byte, 0, 2+len(p.ID)+len(p.Fingerprint)+16+1+len(p.Format)+len(p.Data))
+	var flags byte
+	if p.Kind == payloadValues {
+		flags |= payloadFlagValues
+	}
+	if p.Fingerprint != (fingerprint{}) {
+		flags |= payloadFlagFingerprint
+	}
+	if p.Bound {
+		flags |= payloadFlagBound
+	}
+	data = append(data, cookiePayloadVersion, flags)
+	data = append(data, p.ID[:]...)
+	if flags&payloadFlagFingerprint != 0 {
+		data = append(data, p.Fingerprint[:]...)
+	}
+	if flags&payloadFlagValues != 0 {
+		data = p.appendValues(data)
+	}
+	return data, nil
+}
+
+// appendValues appends the creation and expiry times and the session values.
+func (p *cookiePayload) appendValues(data []byte) []byte {
+	var times [16]byte
+	binary.BigEndian.PutUint64(times[:], uint64(p.CreatedAt))
+	binary.BigEndian.PutUint64(times[8:], uint64(p.ExpiresAt))
+	data = append(data, times[:]...)
+	data = append(data, byte(len(p.Format)))
+	data = append(data, p.Format...)
+	return append(data, p.Data...)
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+func (p *cookiePayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 2+len(p.ID) || data[0] != cookiePayloadVersion {
+		return errors.New("invalid cookie payload")
+	}
+	*p = cookiePayload{}
+	flags := data[1]
+	p.Bound = flags&payloadFlagBound != 0
+	data = data[2:]
+	data = data[copy(p.ID[:], data):]
+	if flags&payloadFlagFingerprint != 0 {
+		if len(data) < len(p.Fingerprint) {
+			return errors.New("invalid cookie payload")
+		}
+		data = data[copy(p.Fingerprint[:], data):]
+	}
+	if flags&payloadFlagValues == 0 {
+		if len(data) != 0 {
+			return errors.New("invalid cookie payload")
+		}
+		return nil
+	}
+	p.Kind = payloadValues
+	return p.unmarshalValues(data)
+}
+
+// unmarshalValues decodes the creation and expiry times and the session values.
+func (p *cookiePayload) unmarshalValues(data []byte) error {
+	if len(data) < 17 {
+		return errors.New("invalid cookie payload")
+	}
+	p.CreatedAt = int64(binary.BigEndian.Uint64(data))
+	p.ExpiresAt = int64(binary.BigEndian.Uint64(data[8:]))
+	formatLen := int(data[16])
+	data = data[17:]
+	if len(data) < formatLen {
+		return errors.New("invalid cookie payload")
+	}
+	p.Format = string(data[:formatLen])
+	p.Data = data[formatLen:]
+	return nil
+}
+
+// decodeCookie decodes the session cookie value.
+func (m *Manager) decodeCookie(value string) (*cookiePayload, *codec.CookieInfo, error) {
+	var payload cookiePayload
+	info, err := m.Codec.DecodeWithInfo(m.name(), value, &payload)
+	if err == nil {
+		return &payload, info, nil
+	}
+	if !codec.IsDeserializeError(err) {
+		return nil, nil, err
+	}
+	// The cookie value is authentic, but was issued before the cookie payload
+	// was introduced, and contains only the session ID. Invalid cookie values
+	// are not decoded again.
+	var sid sessionID
+	if info, sidErr := m.Codec.DecodeWithInfo(m.name(), value, &sid); sidErr == nil {
+		return &cookiePayload{Kind: payloadID, ID: sid, legacy: true}, info, nil
+	}
+	return nil, nil, err
+}
+
+// encodeCookieID encodes the session cookie value for a session that is kept in
+// a session record.
+func (m *Manager) encodeCookieID(sid sessionID, state *sessionState) (string, error) {
+	return m.Codec.Encode(m.name(), &cookiePayload{
+		Kind:        payloadID,
+		ID:          sid,
+		Fingerprint: state.fingerprint,
+		Bound:       state.bound,
+	})
+}
+
+// loadFromCookie loads a session whose values are kept in the session cookie.
+func (m *Manager) loadFromCookie(session *Session, cs *cookiePayload, info *codec.CookieInfo) error {
+	now := nowFunc()
+	session.ID = cs.ID.String()
+	state := &sessionState{
+		sid:         session.ID,
+		createdAt:   time.Unix(cs.CreatedAt, 0),
+		expiresAt:   time.Unix(cs.ExpiresAt, 0),
+		lastSeenAt:  info.IssuedAt,
+		fingerprint: cs.Fingerprint,
+		format:      cs.Format,
+		data:        cs.Data,
+		inCookie:    true,
+		cookie: cookieState{
+			sid:         session.ID,
+			issuedAt:    info.IssuedAt,
+			current:     info.Current,
+			values:      true,
+			fingerprint: cs.Fingerprint,
+		},
+	}
+	if m.isExpired(state, now) {
+		// start a new session with a new ID
+		session.ID = ""
+		return nil
+	}
+	values, err := m.decodeValues(cs.Format, cs.Data)
+	if err != nil {
+		return err
+	}
+	session.Values = values
+	session.IsNew = false
+	session.state = state
+	return nil
+}
+
+// saveInCookie saves the session values in the session cookie, provided that the
+// manager has a cookie values threshold, and the encoded cookie value is not larger
+// than the threshold. It returns false if the session values need to be saved in
+// a session record.
+func (m *Manager) saveInCookie(ctx context.Context, session *Session, state *sessionState, sid sessionID, now time.Time) (bool, error) {
+	if m.CookieValuesThreshold <= 0 || state.bound || state.noCookie {
+		return false, nil
+	}
+	format, data, err := m.encodeValues(session.Values)
+	if err != nil {
+		return false, err
+	}
+	if err := m.Codec.Refresh(ctx); err != nil {
+		return false, err
+	}
+	expiresAt := m.expiresAt(session, state, now)
+	cs := cookiePayload{
+		Kind:        payloadValues,
+		ID:          sid,
+		Fingerprint: state.fingerprint,
+		CreatedAt:   state.createdAt.Unix(),
+		ExpiresAt:   expiresAt.Unix(),
+		Format:      format,
+		Data:        data,
+	}
+	encoded, err := m.Codec.Encode(m.name(), &cs)
+	if err != nil {
+		return false, err
+	}
+	if len(encoded) > m.CookieValuesThreshold {
+		return false, nil
+	}
+	if state.saved {
+		// The session values have shrunk, so the session record is no longer
+		// needed. The session is not bound to a user, because sessions kept in
+		// the cookie cannot be revoked.
+		if m.storageAvailable() != nil {
+			// keep the session record, which is saved when storage is available
+			return false, nil
+		}
+		if err := m.deleteSession(ctx, session.ID); err != nil {
+			return false, err
+		}
+		state.saved = false
+		state.version = 0
+	}
+
+	if state.inCookie && !m.isModified(session, state) && !m.needsCookie(session, state, now) {
+		// Only re-issue the cookie to extend the idle timeout.
+		if m.IdleTimeout <= 0 || expiresAt.Sub(state.expiresAt) < m.touchInterval(session) {
+			return true, nil
+		}
+	}
+	session.setCookie(encoded)
+	state.inCookie = true
+	state.format = format
+	state.data = data
+	state.expiresAt = expiresAt
+	state.lastSeenAt = now
+	state.cookie = cookieState{
+		sid:         session.ID,
+		issuedAt:    now,
+		current:     true,
+		values:      true,
+		fingerprint: state.fingerprint,
+	}
+	return true, nil
+}
+
+// deleteSession deletes the record for the session with ID sid.
+func (m *Manager) deleteSession(ctx context.Context, sid string) error {
+	recordID, err := m.recordID(ctx, sid)
+	if err != nil {
+		return err
+	}
+	return m.DB.Delete(ctx, recordID)
+}
@@ -0,0 +1,208 @@
+package session
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestCookieValues(t *testing.T) {
+	ctx := context.Background()
+	db := &countingProvider{Provider: memory.New()}
+	manager := New(db, "app")
+	manager.CookieValuesThreshold = 400
+
+	// save returns the cookie value if it changed when committing the session
+	save := func(session *Session) string {
+		t.Helper()
+		cookie, err := session.Commit(ctx)
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if !session.CookieChanged() {
+			return ""
+		}
+		return cookie
+	}
+	fetch := func(sid string) bool {
+		t.Helper()
+		rec, err := db.Fetch(ctx, testRecordID(t, manager, sid))
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		return rec != nil
+	}
+
+	// small session is kept in the cookie
+	cookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, cookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	sid := session.ID
+	if fetch(sid) {
+		t.Errorf("want no session record")
+	}
+
+	// unchanged session does not send a cookie
+	if got := save(session); got != "" {
+		t.Errorf("got=%v, want=empty", got)
+	}
+
+	// large session is saved in a session record
+	db.saveCount = 0
+	session.Values["key"] = strings.Repeat("x", 500)
+	cookie = save(session)
+	if cookie == "" {
+		t.Fatal("got=empty, want=non-empty")
+	}
+	if got, want := db.saveCount, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if !fetch(sid) {
+		t.Errorf("session record not found")
+	}
+	session = loadSession(t, manager, cookie)
+	if got, want := session.ID, sid; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], strings.Repeat("x", 500); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// session that shrinks is moved back to the cookie
+	session.Values["key"] = "small"
+	cookie = save(session)
+	if cookie == "" {
+		t.Fatal("got=empty, want=non-empty")
+	}
+	if fetch(sid) {
+		t.Errorf("session record not deleted")
+	}
+	session = loadSession(t, manager, cookie)
+	if got, want := session.ID, sid; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "small"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// session bound to a user is saved in a session record
+	if err := session.BindUser(ctx, "alice"); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if cookie = save(session); cookie == "" {
+		t.Fatal("got=empty, want=non-empty")
+	}
+	if !fetch(sid) {
+		t.Errorf("session record not found")
+	}
+	session = loadSession(t, manager, cookie)
+	session.Values["key"] = "still small"
+	db.fetchCount = 0
+	save(session)
+	if got, want := db.fetchCount, 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if !fetch(sid) {
+		t.Errorf("session record not found")
+	}
+}
+
+func TestCookieValuesIdleTimeout(t *testing.T) {
+	defer restoreStubs()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	manager := New(memory.New().WithTimeNow(nowFunc), "")
+	manager.CookieValuesThreshold = 400
+	manager.IdleTimeout = 30 * time.Minute
+	manager.TouchInterval = 5 * time.Minute
+	cookie := saveNewSession(t, manager)
+
+	// cookie is re-issued to extend the idle timeout
+	fakeNow = fakeNow.Add(10 * time.Minute)
+	session := loadSession(t, manager, cookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	newCookie, err := session.Commit(context.Background())
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := session.CookieChanged(), true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// new cookie is still valid after the idle timeout from the first cookie
+	fakeNow = fakeNow.Add(25 * time.Minute)
+	session = loadSession(t, manager, newCookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// old cookie has timed out
+	session = loadSession(t, manager, cookie)
+	if got, want := session.IsNew, true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestCookiePayload(t *testing.T) {
+	sid := sessionID{1, 2, 3}
+	fp := fingerprint{4, 5, 6}
+	for i, want := range []cookiePayload{
+		{Kind: payloadID, ID: sid},
+		{Kind: payloadID, ID: sid, Fingerprint: fp},
+		{Kind: payloadValues, ID: sid, CreatedAt: 10, ExpiresAt: 20, Format: "gob", Data: []byte("data")},
+		{Kind: payloadValues, ID: sid, Fingerprint: fp, CreatedAt: 10, ExpiresAt: 20, Format: "gob", Data: []byte("data")},
+	} {
+		data, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%d: got=%v, want=nil", i, err)
+		}
+		var got cookiePayload
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%d: got=%v, want=nil", i, err)
+		}
+		if !samePayload(&got, &want) {
+			t.Errorf("%d: got=%+v, want=%+v", i, got, want)
+		}
+		if err := got.UnmarshalBinary(data[:len(sid)]); err == nil {
+			t.Errorf("%d: got=nil, want=error", i)
+		}
+	}
+
+	// a cookie containing only the session ID is still accepted
+	ctx := context.Background()
+	manager := New(memory.New(), "app")
+	cookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, cookie)
+	sid, err := parseSessionID(session.ID)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if cookie, err = manager.Codec.Encode(manager.name(), sid); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	session, err = manager.Load(ctx, cookie)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func samePayload(p1, p2 *cookiePayload) bool {
+	return p1.Kind == p2.Kind && p1.ID == p2.ID && p1.Fingerprint == p2.Fingerprint &&
+		p1.CreatedAt == p2.CreatedAt && p1.ExpiresAt == p2.ExpiresAt &&
+		p1.Format == p2.Format && string(p1.Data) == string(p2.Data)
+}
@@ -0,0 +1,275 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+)
+
+// DegradationPolicy determines how sessions behave when the storage provider is
+// unavailable.
+type DegradationPolicy int
+
+// Degradation policies.
+const (
+	// FailClosed returns storage errors from Load and Commit. This is the
+	// behavior when the manager does not have a Degradation.
+	FailClosed DegradationPolicy = iota
+
+	// ReadOnly treats sessions that cannot be loaded as new, anonymous sessions,
+	// and does not save them. The client's session cookie is left unchanged, so
+	// the client's session is available again once the storage provider recovers.
+	ReadOnly
+
+	// MemoryFallback saves sessions in memory when they cannot be saved to the
+	// storage provider, and writes them to the storage provider once it recovers.
+	// Sessions that are not in memory are treated as for ReadOnly. Writes from
+	// memory replace the session records without a version check.
+	MemoryFallback
+)
+
+const (
+	// defaultFallbackSize is the maximum number of session records held in memory
+	// if the degradation does not specify a maximum.
+	defaultFallbackSize = 10000
+
+	// defaultRetryInterval is the retry interval if the degradation does not
+	// specify one.
+	defaultRetryInterval = 5 * time.Second
+)
+
+// errUnavailable is the error reported while the storage provider is assumed
+// to still be unavailable, and is not being called.
+var errUnavailable = errors.New("storage provider unavailable")
+
+// Degradation determines what happens when the storage provider is unavailable.
+//
+// Once a storage operation fails, the storage provider is assumed to be unavailable
+// for RetryInterval, during which it is not called, so that requests are not each
+// delayed waiting for it to time out. Each degradation is reported to the manager's
+// event sink as an EventDegraded event.
+//
+// Storage errors when destroying sessions, or when binding and revoking user sessions,
+// are always returned, unless the policy is MemoryFallback, in which case destroyed
+// sessions are deleted from storage once it recovers.
+//
+// A Degradation is shared by every copy of the Manager that refers to it, and must
+// not be modified once it is in use.
+type Degradation struct {
+	Policy        DegradationPolicy
+	MaxSessions   int           // maximum sessions held in memory, 10000 if zero
+	RetryInterval time.Duration // time to wait before calling the provider again, 5s if zero
+
+	mutex       sync.Mutex
+	unavailable time.Time                  // provider not called until this time
+	pending     map[string]*storage.Record // writes not yet saved, nil if deleted
+	order       []string                   // record IDs of pending, oldest first
+}
+
+// available reports whether the storage provider should be called.
+func (d *Degradation) available(now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return !now.Before(d.unavailable)
+}
+
+// failed records a storage failure at time now.
+func (d *Degradation) failed(now time.Time) {
+	interval := d.RetryInterval
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+	d.mutex.Lock()
+	d.unavailable = now.Add(interval)
+	d.mutex.Unlock()
+}
+
+// get returns the pending write for the record ID. The record is nil if
+// it has been deleted.
+func (d *Degradation) get(id string) (*storage.Record, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	rec, ok := d.pending[id]
+	return rec, ok
+}
+
+// put saves a pending write for the record ID. If there are too many pending
+// writes, the oldest is discarded.
+func (d *Degradation) put(id string, rec *storage.Record) {
+	max := d.MaxSessions
+	if max <= 0 {
+		max = defaultFallbackSize
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string]*storage.Record)
+	}
+	if _, ok := d.pending[id]; !ok {
+		d.order = append(d.order, id)
+	}
+	d.pending[id] = rec
+	for len(d.order) > max {
+		delete(d.pending, d.order[0])
+		d.order = d.order[1:]
+	}
+}
+
+// snapshot returns a copy of the pending writes.
+func (d *Degradation) snapshot() map[string]*storage.Record {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pending := make(map[string]*storage.Record, len(d.pending))
+	for id, rec := range d.pending {
+		pending[id] = rec
+	}
+	return pending
+}
+
+// remove removes the pending write for the record ID, unless it has
+// been replaced since rec was obtained.
+func (d *Degradation) remove(id string, rec *storage.Record) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if current, ok := d.pending[id]; !ok || current != rec {
+		return
+	}
+	delete(d.pending, id)
+	for i, pendingID := range d.order {
+		if pendingID == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// degraded reports whether the manager degrades gracefully when the storage
+// provider is unavailable.
+func (m *Manager) degraded() bool {
+	return m.Degradation != nil && m.Degradation.Policy != FailClosed
+}
+
+// memoryFallback reports whether the manager saves sessions in memory when the
+// storage provider is unavailable.
+func (m *Manager) memoryFallback() bool {
+	return m.Degradation != nil && m.Degradation.Policy == MemoryFallback
+}
+
+// storageFailed reports a storage failure, and returns true if the manager
+// degrades gracefully. Conflicts are not storage failures.
+func (m *Manager) storageFailed(ctx context.Context, op string, err error) bool {
+	if !m.degraded() {
+		return false
+	}
+	if _, ok := err.(*ConflictError); ok || err == storage.ErrVersionConflict {
+		return false
+	}
+	if err != errUnavailable {
+		m.Degradation.failed(nowFunc())
+	}
+	m.emit(ctx, &Event{Type: EventDegraded, Reason: op + ": " + err.Error()})
+	return true
+}
+
+// fetchRecord fetches the record for the session with ID sid, using the pending
+// writes if the manager has a memory fallback.
+func (m *Manager) fetchRecord(ctx context.Context, sid string) (*storage.Record, error) {
+	if m.Degradation == nil {
+		return m.fetchSession(ctx, sid)
+	}
+	if m.memoryFallback() {
+		m.reconcile(ctx)
+		recordID, err := m.recordID(ctx, sid)
+		if err != nil {
+			return nil, err
+		}
+		if rec, ok := m.Degradation.get(recordID); ok {
+			return rec, nil
+		}
+	}
+	if !m.Degradation.available(nowFunc()) {
+		return nil, errUnavailable
+	}
+	return m.fetchSession(ctx, sid)
+}
+
+// saveFailed handles a failure to save the session record rec. It returns nil if
+// the manager degrades gracefully, in which case the record has been saved in memory,
+// or the session has been made read-only.
+func (m *Manager) saveFailed(ctx context.Context, session *Session, rec *storage.Record, err error) error {
+	if !m.storageFailed(ctx, "save", err) {
+		return err
+	}
+	if m.memoryFallback() {
+		saved := *rec
+		m.Degradation.put(rec.ID, &saved)
+	} else {
+		session.readOnly = true
+	}
+	return nil
+}
+
+// deleteFailed handles a failure to delete the record for the session with ID
+// sid. It returns nil if the manager has a memory fallback, in which case the
+// record will be deleted once the storage provider recovers.
+func (m *Manager) deleteFailed(ctx context.Context, sid string, err error) error {
+	if !m.memoryFallback() || !m.storageFailed(ctx, "delete", err) {
+		return err
+	}
+	recordID, err := m.recordID(ctx, sid)
+	if err != nil {
+		return err
+	}
+	m.Degradation.put(recordID, nil)
+	return nil
+}
+
+// degradedSession returns a new, read-only session, which is used when the session
+// for cookieValue cannot be loaded because the storage provider is unavailable.
+func (m *Manager) degradedSession(ctx context.Context, cookieValue string) *Session {
+	session := m.NewSession()
+	setClient(ctx, session)
+	session.cookieValue = cookieValue
+	session.readOnly = true
+	return session
+}
+
+// storageAvailable returns errUnavailable if the storage provider is assumed
+// to be unavailable.
+func (m *Manager) storageAvailable() error {
+	if m.Degradation != nil && !m.Degradation.available(nowFunc()) {
+		return errUnavailable
+	}
+	return nil
+}
+
+// reconcile writes the pending writes held in memory to the storage provider,
+// if it is available.
+func (m *Manager) reconcile(ctx context.Context) {
+	d := m.Degradation
+	now := nowFunc()
+	if !d.available(now) {
+		return
+	}
+	pending := d.snapshot()
+	if len(pending) == 0 {
+		return
+	}
+	for id, rec := range pending {
+		var err error
+		if rec == nil {
+			err = m.DB.Delete(ctx, id)
+		} else {
+			err = m.DB.Save(ctx, rec, -1)
+		}
+		if err != nil {
+			d.failed(now)
+			return
+		}
+		d.remove(id, rec)
+	}
+	m.emit(ctx, &Event{Type: EventDegraded, Reason: "reconciled"})
+}
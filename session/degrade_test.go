@@ -0,0 +1,193 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+// outageProvider is a storage provider that fails while down is set.
+type outageProvider struct {
+	storage.Provider
+	down bool
+}
+
+var errOutage = errors.New("connection refused")
+
+func (p *outageProvider) Fetch(ctx context.Context, id string) (*storage.Record, error) {
+	if p.down {
+		return nil, errOutage
+	}
+	return p.Provider.Fetch(ctx, id)
+}
+
+func (p *outageProvider) Save(ctx context.Context, rec *storage.Record, expectVersion int64) error {
+	if p.down {
+		return errOutage
+	}
+	return p.Provider.Save(ctx, rec, expectVersion)
+}
+
+func (p *outageProvider) Delete(ctx context.Context, id string) error {
+	if p.down {
+		return errOutage
+	}
+	return p.Provider.Delete(ctx, id)
+}
+
+func TestDegradationFailClosed(t *testing.T) {
+	ctx := context.Background()
+	db := &outageProvider{Provider: memory.New()}
+	manager := New(db, "app")
+	cookie := saveNewSession(t, manager)
+
+	db.down = true
+	if _, err := manager.Load(ctx, cookie); err == nil {
+		t.Error("got=nil, want=error")
+	}
+	session := manager.NewSession()
+	session.Values["key"] = "value"
+	if _, err := session.Commit(ctx); err == nil {
+		t.Error("got=nil, want=error")
+	}
+}
+
+func TestDegradationReadOnly(t *testing.T) {
+	defer restoreStubs()
+	ctx := context.Background()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	sink := &MemorySink{}
+	db := &outageProvider{Provider: memory.New()}
+	manager := New(db, "app")
+	manager.Events = sink
+	manager.Degradation = &Degradation{Policy: ReadOnly}
+	cookie := saveNewSession(t, manager)
+	sink.Reset()
+
+	db.down = true
+	session, err := manager.Load(ctx, cookie)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if !session.Degraded() || !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("got=%v, want=degraded anonymous session", session)
+	}
+	session.Values["key"] = "changed"
+	value, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := value, cookie; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if session.CookieChanged() {
+		t.Error("got=true, want=false")
+	}
+
+	// new sessions cannot be saved either
+	session = manager.NewSession()
+	session.Values["key"] = "value"
+	if value, err := session.Commit(ctx); err != nil || value != "" {
+		t.Fatalf("got=%q, %v, want=empty, nil", value, err)
+	}
+	if !session.Degraded() {
+		t.Error("got=false, want=true")
+	}
+	events := sink.Events()
+	if got, want := len(events), 2; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	for _, event := range events {
+		if got, want := event.Type, EventDegraded; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+	}
+
+	// the original session is available once storage recovers
+	db.down = false
+	fakeNow = fakeNow.Add(defaultRetryInterval)
+	session = loadSession(t, manager, cookie)
+	if session.Degraded() || session.IsNew {
+		t.Error("got=degraded, want=loaded")
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestDegradationMemoryFallback(t *testing.T) {
+	defer restoreStubs()
+	ctx := context.Background()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	sink := &MemorySink{}
+	db := &outageProvider{Provider: memory.New()}
+	manager := New(db, "app")
+	manager.Events = sink
+	manager.Degradation = &Degradation{Policy: MemoryFallback, RetryInterval: time.Minute}
+	destroyed := loadSession(t, manager, saveNewSession(t, manager))
+
+	db.down = true
+	session := manager.NewSession()
+	session.Values["key"] = "value"
+	cookie, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if session.Degraded() {
+		t.Error("got=true, want=false")
+	}
+	if err := destroyed.Destroy(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	// the session is loaded from memory during the outage
+	session = loadSession(t, manager, cookie)
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// pending writes are not written until the retry interval has passed
+	db.down = false
+	session = loadSession(t, manager, cookie)
+	if rec, _ := db.Provider.Fetch(ctx, testRecordID(t, manager, session.ID)); rec != nil {
+		t.Errorf("got=%v, want=nil", rec)
+	}
+	fakeNow = fakeNow.Add(time.Minute)
+	sink.Reset()
+	session = loadSession(t, manager, cookie)
+	if rec, _ := db.Provider.Fetch(ctx, testRecordID(t, manager, session.ID)); rec == nil {
+		t.Error("got=nil, want=record")
+	}
+	if rec, _ := db.Provider.Fetch(ctx, testRecordID(t, manager, destroyed.ID)); rec != nil {
+		t.Errorf("got=%v, want=nil", rec)
+	}
+	events := sink.Events()
+	if len(events) == 0 || events[0].Type != EventDegraded || events[0].Reason != "reconciled" {
+		t.Errorf("got=%v, want=reconciled event", events)
+	}
+}
+
+func TestDegradationMaxSessions(t *testing.T) {
+	d := &Degradation{MaxSessions: 2}
+	for _, id := range []string{"a", "b", "c"} {
+		d.put(id, &storage.Record{ID: id})
+	}
+	if _, ok := d.get("a"); ok {
+		t.Error("got=true, want=false")
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, ok := d.get(id); !ok {
+			t.Errorf("%s: got=false, want=true", id)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+// countingProvider counts the number of calls to Fetch, Save, Touch and Delete.
+type countingProvider struct {
+	*memory.Provider
+	fetchCount  int
+	saveCount   int
+	touchCount  int
+	deleteCount int
+}
+
+func (db *countingProvider) Fetch(ctx context.Context, id string) (*storage.Record, error) {
+	db.fetchCount++
+	return db.Provider.Fetch(ctx, id)
+}
+
+func (db *countingProvider) Save(ctx context.Context, rec *storage.Record, oldVersion int64) error {
+	db.saveCount++
+	return db.Provider.Save(ctx, rec, oldVersion)
+}
+
+func (db *countingProvider) Touch(ctx context.Context, id string, expiresAt, lastSeenAt time.Time) error {
+	db.touchCount++
+	return db.Provider.Touch(ctx, id, expiresAt, lastSeenAt)
+}
+
+func (db *countingProvider) Delete(ctx context.Context, id string) error {
+	db.deleteCount++
+	return db.Provider.Delete(ctx, id)
+}
+
+func TestDirtyTracking(t *testing.T) {
+	defer restoreStubs()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	db := &countingProvider{Provider: memory.New().WithTimeNow(nowFunc)}
+	manager := New(db, "")
+	manager.MaxAge = time.Hour
+	cookie := saveNewSession(t, manager)
+
+	// save returns the number of cookies sent when committing the session
+	save := func(session *Session) int {
+		t.Helper()
+		if _, err := session.Commit(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if session.CookieChanged() {
+			return 1
+		}
+		return 0
+	}
+
+	// unchanged session is not written, and no cookie is sent
+	db.saveCount = 0
+	session := loadSession(t, manager, cookie)
+	if got, want := save(session), 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := db.saveCount, 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// modified session is written, but the cookie does not need to be sent
+	session.Values["key"] = "another value"
+	if got, want := save(session), 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := db.saveCount, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	session = loadSession(t, manager, cookie)
+	if got, want := session.Values["key"], "another value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// a cookie more than half way through its max age is sent again,
+	// and the unchanged session record expiry is extended
+	fakeNow = fakeNow.Add(31 * time.Minute)
+	db.touchCount = 0
+	session = loadSession(t, manager, cookie)
+	if got, want := save(session), 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := db.saveCount, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := db.touchCount, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,15 @@
+// Package session provides a session manager for persistence of session data.
+//
+// The session manager does not depend on net/http or on Gorilla sessions. A session
+// is loaded from the value of the session cookie, and committing the session returns
+// the cookie value to send to the client. This means that sessions can be used from
+// any kind of server, such as a gRPC gateway, and that session cookies can be
+// validated by services that never see an HTTP request.
+//
+// The session manager also persists randomly generated secret keying material that
+// is used for generating the keys used to sign and encrypt the secure session
+// cookies. The secret keying material is regularly rotated.
+//
+// Package sessionstore provides a Gorilla sessions store that is an adapter over
+// the session manager.
+package session
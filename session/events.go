@@ -0,0 +1,134 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventType identifies a session lifecycle event.
+type EventType int
+
+// Session lifecycle events.
+const (
+	EventCreated             EventType = iota + 1 // new session saved for the first time
+	EventLoaded                                   // existing session loaded
+	EventSaved                                    // changes to an existing session saved
+	EventIDRegenerated                            // session given a new session ID
+	EventDestroyed                                // session destroyed or revoked
+	EventDecodeFailed                             // session cookie could not be decoded
+	EventExpiredOnLoad                            // session cookie refers to an expired session
+	EventFingerprintMismatch                      // client fingerprint does not match the session
+	EventDegraded                                 // storage provider unavailable, or recovered
+)
+
+var eventTypeNames = map[EventType]string{
+	EventCreated:             "created",
+	EventLoaded:              "loaded",
+	EventSaved:               "saved",
+	EventIDRegenerated:       "id_regenerated",
+	EventDestroyed:           "destroyed",
+	EventDecodeFailed:        "decode_failed",
+	EventExpiredOnLoad:       "expired_on_load",
+	EventFingerprintMismatch: "fingerprint_mismatch",
+	EventDegraded:            "degraded",
+}
+
+// String implements the fmt.Stringer interface.
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to a session.
+//
+// Session IDs are bearer credentials, so if the manager has HashIDs set, the
+// SessionID and PrevSessionID fields contain the keyed hash of the session ID
+// that is used to store the session record, and Hashed is true. Otherwise they
+// contain the session ID itself, and sinks should take care not to expose them.
+type Event struct {
+	Type          EventType
+	SessionID     string    // session ID, or its keyed hash
+	PrevSessionID string    // previous session ID for EventIDRegenerated
+	Hashed        bool      // session IDs are keyed hashes
+	AppID         string    // manager's AppID
+	Name          string    // session cookie name
+	Reason        string    // why the event happened, may be empty
+	Time          time.Time // when the event happened
+}
+
+// EventSink receives session lifecycle events from a Manager.
+//
+// Events are delivered synchronously, while the session is being loaded or
+// committed, so SessionEvent should return quickly. It must be safe for
+// concurrent use.
+type EventSink interface {
+	SessionEvent(ctx context.Context, event *Event)
+}
+
+// MemorySink is an EventSink that keeps the events it receives in memory.
+// It is intended for testing.
+type MemorySink struct {
+	mutex  sync.Mutex
+	events []*Event
+}
+
+// SessionEvent implements the EventSink interface.
+func (s *MemorySink) SessionEvent(ctx context.Context, event *Event) {
+	s.mutex.Lock()
+	s.events = append(s.events, event)
+	s.mutex.Unlock()
+}
+
+// Events returns the events received, in the order they were received.
+func (s *MemorySink) Events() []*Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*Event(nil), s.events...)
+}
+
+// Reset discards the events received.
+func (s *MemorySink) Reset() {
+	s.mutex.Lock()
+	s.events = nil
+	s.mutex.Unlock()
+}
+
+// emit sends an event to the manager's event sink, if it has one. The session
+// ID and previous session ID in event are replaced with their session keys.
+func (m *Manager) emit(ctx context.Context, event *Event) {
+	if m.Events == nil {
+		return
+	}
+	event.SessionID = m.eventSessionID(ctx, event.SessionID)
+	event.PrevSessionID = m.eventSessionID(ctx, event.PrevSessionID)
+	m.send(ctx, event)
+}
+
+// send sends an event whose session IDs are already session keys to the
+// manager's event sink, if it has one.
+func (m *Manager) send(ctx context.Context, event *Event) {
+	if m.Events == nil {
+		return
+	}
+	event.AppID = m.AppID
+	event.Name = m.name()
+	event.Hashed = m.HashIDs
+	event.Time = nowFunc()
+	m.Events.SessionEvent(ctx, event)
+}
+
+// eventSessionID returns the session ID to report in an event for session ID sid.
+func (m *Manager) eventSessionID(ctx context.Context, sid string) string {
+	if sid == "" {
+		return ""
+	}
+	key, err := m.sessionKey(ctx, sid)
+	if err != nil {
+		// never report the session ID if it should be hashed
+		return ""
+	}
+	return key
+}
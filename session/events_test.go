@@ -0,0 +1,105 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestEvents(t *testing.T) {
+	ctx := context.Background()
+	sink := &MemorySink{}
+	manager := New(memory.New(), "app")
+	manager.Events = sink
+
+	// checkEvents compares the types of the events received with want
+	checkEvents := func(want ...EventType) []*Event {
+		t.Helper()
+		events := sink.Events()
+		sink.Reset()
+		if got, want := len(events), len(want); got != want {
+			t.Fatalf("got=%v, want=%v", got, want)
+		}
+		for i, event := range events {
+			if got, want := event.Type, want[i]; got != want {
+				t.Errorf("%d: got=%v, want=%v", i, got, want)
+			}
+			if got, want := event.AppID, "app"; got != want {
+				t.Errorf("%d: got=%v, want=%v", i, got, want)
+			}
+			if event.Time.IsZero() {
+				t.Errorf("%d: got=zero, want=time", i)
+			}
+		}
+		return events
+	}
+
+	cookie := saveNewSession(t, manager)
+	events := checkEvents(EventCreated)
+	session := loadSession(t, manager, cookie)
+	if got, want := events[0].SessionID, session.ID; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	checkEvents(EventLoaded)
+
+	// unchanged session is not saved
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	checkEvents()
+	session.Values["key"] = "changed"
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	checkEvents(EventSaved)
+
+	oldID := session.ID
+	if _, err := session.RegenerateID(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	events = checkEvents(EventIDRegenerated)
+	if got, want := events[0].PrevSessionID, oldID; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	if err := session.Destroy(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	checkEvents(EventDestroyed)
+	loadSession(t, manager, cookie)
+	events = checkEvents(EventExpiredOnLoad)
+	if got, want := events[0].Reason, "not found"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	if _, err := manager.Load(ctx, "garbage"); err == nil {
+		t.Fatal("got=nil, want=error")
+	}
+	checkEvents(EventDecodeFailed)
+}
+
+func TestEventsHashIDs(t *testing.T) {
+	sink := &MemorySink{}
+	manager := New(memory.New(), "app")
+	manager.HashIDs = true
+	manager.Events = sink
+
+	cookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, cookie)
+	key, err := manager.sessionKey(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(sink.Events()), 2; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	for _, event := range sink.Events() {
+		if event.SessionID == session.ID {
+			t.Errorf("%v: got=session ID, want=hashed session ID", event.Type)
+		}
+		if got, want := event.SessionID, key; got != want {
+			t.Errorf("%v: got=%v, want=%v", event.Type, got, want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestSlidingExpiration(t *testing.T) {
+	defer restoreStubs()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	db := memory.New().WithTimeNow(nowFunc)
+	manager := New(db, "app")
+	manager.IdleTimeout = 30 * time.Minute
+	manager.AbsoluteTimeout = 2 * time.Hour
+	manager.TouchInterval = 5 * time.Minute
+
+	cookie := saveNewSession(t, manager)
+	recordID := func() string {
+		session := loadSession(t, manager, cookie)
+		return testRecordID(t, manager, session.ID)
+	}
+	id := recordID()
+	expiresAt := func() time.Time {
+		rec, err := db.Fetch(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec == nil {
+			return time.Time{}
+		}
+		return rec.ExpiresAt
+	}
+	if got, want := expiresAt(), fakeNow.Add(manager.IdleTimeout); !got.Equal(want) {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// within the touch interval, so expiry is not extended
+	fakeNow = fakeNow.Add(4 * time.Minute)
+	prevExpiresAt := expiresAt()
+	if got, want := loadSession(t, manager, cookie).IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := expiresAt(), prevExpiresAt; !got.Equal(want) {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// keep using the session for longer than the idle timeout
+	for i := 0; i < 4; i++ {
+		fakeNow = fakeNow.Add(20 * time.Minute)
+		if got, want := loadSession(t, manager, cookie).IsNew, false; got != want {
+			t.Fatalf("%d: got=%v, want=%v", i, got, want)
+		}
+		if got, want := expiresAt(), fakeNow.Add(manager.IdleTimeout); !got.Equal(want) {
+			t.Fatalf("%d: got=%v, want=%v", i, got, want)
+		}
+	}
+
+	// the absolute timeout limits the expiry time
+	fakeNow = fakeNow.Add(20 * time.Minute)
+	if got, want := loadSession(t, manager, cookie).IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	createdAt := fakeNow.Add(-104 * time.Minute)
+	if got, want := expiresAt(), createdAt.Add(manager.AbsoluteTimeout); !got.Equal(want) {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// past the absolute timeout
+	fakeNow = fakeNow.Add(20 * time.Minute)
+	session := loadSession(t, manager, cookie)
+	if got, want := session.IsNew, true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.ID, ""; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	defer restoreStubs()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	db := memory.New().WithTimeNow(nowFunc)
+	manager := New(db, "")
+	manager.IdleTimeout = 30 * time.Minute
+
+	cookie := saveNewSession(t, manager)
+	fakeNow = fakeNow.Add(29 * time.Minute)
+	if got, want := loadSession(t, manager, cookie).IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	fakeNow = fakeNow.Add(31 * time.Minute)
+	if got, want := loadSession(t, manager, cookie).IsNew, true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+}
+
+// saveNewSession creates and commits a new session, returning the session cookie value.
+func saveNewSession(t *testing.T, manager *Manager) string {
+	t.Helper()
+	session, err := manager.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["key"] = "value"
+	cookie, err := session.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.CookieChanged() {
+		t.Fatal("got=false, want=true")
+	}
+	return cookie
+}
+
+// loadSession loads the session for the cookie value.
+func loadSession(t *testing.T, manager *Manager, cookie string) *Session {
+	t.Helper()
+	session, err := manager.Load(context.Background(), cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// testRecordID returns the record ID for the session ID sid.
+func testRecordID(t *testing.T, manager *Manager, sid string) string {
+	t.Helper()
+	id, err := manager.recordID(context.Background(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -0,0 +1,190 @@
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"strings"
+)
+
+// FingerprintFunc returns a value that identifies the client using a session.
+// It is called with the session after the session's ClientIP and UserAgent
+// fields have been set. The value can be anything that is expected to stay the
+// same for the lifetime of a session, including values obtained from ctx.
+type FingerprintFunc func(ctx context.Context, s *Session) string
+
+// FingerprintPolicy determines what happens when a session is loaded by a client
+// whose fingerprint does not match the fingerprint recorded for the session.
+type FingerprintPolicy int
+
+// Fingerprint policies.
+const (
+	FingerprintAllow   FingerprintPolicy = iota // load the session, report the mismatch as an event
+	FingerprintFlag                             // load the session, Load returns a *FingerprintError
+	FingerprintDestroy                          // delete the session, Load returns a new session
+)
+
+// FingerprintError is the error returned by Load when the client's fingerprint
+// does not match the fingerprint recorded for the session, and the manager's
+// fingerprint policy is FingerprintFlag. The session is returned with the error.
+type FingerprintError struct {
+	Name string // session name
+}
+
+// Error implements the error interface.
+func (e *FingerprintError) Error() string {
+	return "session fingerprint does not match client: " + e.Name
+}
+
+// ClientIPPrefix is a FingerprintFunc that returns the network prefix of the
+// session's client IP address: the /24 prefix for IPv4 addresses, and the /48
+// prefix for IPv6 addresses. Clients that move between networks will not match.
+func ClientIPPrefix(ctx context.Context, s *Session) string {
+	ip := net.ParseIP(s.ClientIP)
+	if ip == nil {
+		return s.ClientIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// UserAgentFamily is a FingerprintFunc that returns the browser family and the
+// operating system family of the session's user agent, for example "Firefox/Linux".
+// Version numbers are ignored, so the fingerprint does not change when the browser
+// is upgraded.
+func UserAgentFamily(ctx context.Context, s *Session) string {
+	return browserFamily(s.UserAgent) + "/" + osFamily(s.UserAgent)
+}
+
+// CombineFingerprints returns a FingerprintFunc that combines the fingerprints
+// returned by funcs. The combined fingerprint only matches if every one of the
+// individual fingerprints match.
+func CombineFingerprints(funcs ...FingerprintFunc) FingerprintFunc {
+	return func(ctx context.Context, s *Session) string {
+		values := make([]string, len(funcs))
+		for i, f := range funcs {
+			values[i] = f(ctx, s)
+		}
+		return strings.Join(values, "\x00")
+	}
+}
+
+// browserFamily returns the browser family of the user agent. The order of the
+// checks is important, because most user agents claim to be several browsers.
+func browserFamily(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Edg/"), strings.Contains(userAgent, "Edge/"):
+		return "Edge"
+	case strings.Contains(userAgent, "OPR/"), strings.Contains(userAgent, "Opera"):
+		return "Opera"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		return "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		return "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		return "Safari"
+	}
+	// other clients, such as curl/7.64.1
+	if i := strings.IndexAny(userAgent, "/ "); i >= 0 {
+		return userAgent[:i]
+	}
+	return userAgent
+}
+
+// osFamily returns the operating system family of the user agent.
+func osFamily(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		return "iOS"
+	case strings.Contains(userAgent, "Android"):
+		return "Android"
+	case strings.Contains(userAgent, "Windows"):
+		return "Windows"
+	case strings.Contains(userAgent, "Mac OS X"), strings.Contains(userAgent, "Macintosh"):
+		return "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		return "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		return "Linux"
+	}
+	return "Other"
+}
+
+// fingerprint is the hash of a client fingerprint, which is kept in the session
+// cookie. The cookie is encrypted and authenticated, so the client cannot change
+// the fingerprint that was recorded when the session was created.
+type fingerprint [16]byte
+
+// fingerprint returns the fingerprint of the client using the session, or
+// the zero fingerprint if the manager does not fingerprint clients.
+func (m *Manager) fingerprint(ctx context.Context, session *Session) fingerprint {
+	var fp fingerprint
+	if m.Fingerprint != nil {
+		sum := sha256.Sum256([]byte(m.Fingerprint(ctx, session)))
+		copy(fp[:], sum[:])
+	}
+	return fp
+}
+
+// checkFingerprint compares the fingerprint of the client with the fingerprint
+// recorded for the loaded session, and applies the manager's fingerprint policy
+// if they do not match. It returns the session to use, which is a new session if
+// the loaded session was destroyed.
+func (m *Manager) checkFingerprint(ctx context.Context, session *Session) (*Session, error) {
+	state := session.state
+	if m.Fingerprint == nil || state == nil || state.fingerprint == (fingerprint{}) {
+		// Sessions created before fingerprints were recorded are given
+		// a fingerprint when they are next committed.
+		return session, nil
+	}
+	if m.fingerprint(ctx, session) == state.fingerprint {
+		return session, nil
+	}
+	switch m.FingerprintPolicy {
+	case FingerprintFlag:
+		m.emit(ctx, &Event{Type: EventFingerprintMismatch, SessionID: session.ID, Reason: "flagged"})
+		return session, &FingerprintError{Name: m.name()}
+	case FingerprintDestroy:
+		m.emit(ctx, &Event{Type: EventFingerprintMismatch, SessionID: session.ID, Reason: "destroyed"})
+		if !state.inCookie {
+			if err := m.deleteSession(ctx, session.ID); err != nil {
+				return session, err
+			}
+		}
+		m.emit(ctx, &Event{Type: EventDestroyed, SessionID: session.ID, Reason: "fingerprint mismatch"})
+		newSession := m.NewSession()
+		newSession.ClientIP = session.ClientIP
+		newSession.UserAgent = session.UserAgent
+		newSession.cookieValue = session.cookieValue
+		return newSession, nil
+	}
+	m.emit(ctx, &Event{Type: EventFingerprintMismatch, SessionID: session.ID, Reason: "allowed"})
+	return session, nil
+}
+
+// clientKey is the context key for the client.
+type clientKey struct{}
+
+// client identifies the client using a session.
+type client struct {
+	ip        string
+	userAgent string
+}
+
+// WithClient returns a copy of ctx that identifies the client by its IP address
+// and user agent. When Load is called with the returned context, the loaded
+// session's ClientIP and UserAgent fields are set before the client's fingerprint
+// is checked.
+func WithClient(ctx context.Context, clientIP, userAgent string) context.Context {
+	return context.WithValue(ctx, clientKey{}, &client{ip: clientIP, userAgent: userAgent})
+}
+
+// setClient sets the session's client IP address and user agent from ctx.
+func setClient(ctx context.Context, session *Session) {
+	if c, ok := ctx.Value(clientKey{}).(*client); ok {
+		session.ClientIP = c.ip
+		session.UserAgent = c.userAgent
+	}
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestFingerprintFuncs(t *testing.T) {
+	tests := []struct {
+		clientIP  string
+		userAgent string
+		ipPrefix  string
+		uaFamily  string
+	}{
+		{
+			clientIP:  "192.0.2.123",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0",
+			ipPrefix:  "192.0.2.0/24",
+			uaFamily:  "Firefox/Linux",
+		},
+		{
+			clientIP:  "2001:db8:1234:5678::1",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0",
+			ipPrefix:  "2001:db8:1234::/48",
+			uaFamily:  "Edge/Windows",
+		},
+		{
+			clientIP:  "not-an-ip",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1",
+			ipPrefix:  "not-an-ip",
+			uaFamily:  "Safari/iOS",
+		},
+		{
+			userAgent: "curl/7.64.1",
+			uaFamily:  "curl/Other",
+		},
+	}
+	for i, tt := range tests {
+		s := &Session{ClientIP: tt.clientIP, UserAgent: tt.userAgent}
+		if got, want := ClientIPPrefix(context.Background(), s), tt.ipPrefix; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+		if got, want := UserAgentFamily(context.Background(), s), tt.uaFamily; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+	}
+}
+
+func TestFingerprintPolicy(t *testing.T) {
+	home := WithClient(context.Background(), "192.0.2.1", "phone")
+	nearby := WithClient(context.Background(), "192.0.2.200", "phone")
+	elsewhere := WithClient(context.Background(), "198.51.100.1", "phone")
+
+	for _, threshold := range []int{0, 1000} {
+		for _, policy := range []FingerprintPolicy{FingerprintAllow, FingerprintFlag, FingerprintDestroy} {
+			sink := &MemorySink{}
+			manager := New(memory.New(), "app")
+			manager.Fingerprint = ClientIPPrefix
+			manager.FingerprintPolicy = policy
+			manager.CookieValuesThreshold = threshold
+			manager.Events = sink
+
+			session, err := manager.Load(home, "")
+			if err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			if got, want := session.ClientIP, "192.0.2.1"; got != want {
+				t.Errorf("got=%v, want=%v", got, want)
+			}
+			session.Values["key"] = "value"
+			cookie, err := session.Commit(home)
+			if err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+
+			// same network
+			session, err = manager.Load(nearby, cookie)
+			if err != nil {
+				t.Fatalf("%d/%d: got=%v, want=nil", threshold, policy, err)
+			}
+			if got, want := session.IsNew, false; got != want {
+				t.Errorf("%d/%d: got=%v, want=%v", threshold, policy, got, want)
+			}
+
+			// different network
+			sink.Reset()
+			session, err = manager.Load(elsewhere, cookie)
+			switch policy {
+			case FingerprintAllow:
+				if err != nil {
+					t.Errorf("%d/%d: got=%v, want=nil", threshold, policy, err)
+				}
+				if got, want := session.IsNew, false; got != want {
+					t.Errorf("%d/%d: got=%v, want=%v", threshold, policy, got, want)
+				}
+			case FingerprintFlag:
+				if _, ok := err.(*FingerprintError); !ok {
+					t.Errorf("%d/%d: got=%v, want=*FingerprintError", threshold, policy, err)
+				}
+				if got, want := session.Values["key"], "value"; got != want {
+					t.Errorf("%d/%d: got=%v, want=%v", threshold, policy, got, want)
+				}
+			case FingerprintDestroy:
+				if err != nil {
+					t.Errorf("%d/%d: got=%v, want=nil", threshold, policy, err)
+				}
+				if got, want := session.IsNew, true; got != want {
+					t.Errorf("%d/%d: got=%v, want=%v", threshold, policy, got, want)
+				}
+				if threshold == 0 {
+					// the session record has been deleted
+					if got, want := loadSession(t, manager, cookie).IsNew, true; got != want {
+						t.Errorf("%d/%d: got=%v, want=%v", threshold, policy, got, want)
+					}
+				}
+			}
+			events := sink.Events()
+			if len(events) == 0 {
+				t.Fatalf("%d/%d: got=no events, want=events", threshold, policy)
+			}
+			if got, want := events[0].Type, EventFingerprintMismatch; got != want {
+				t.Errorf("%d/%d: got=%v, want=%v", threshold, policy, got, want)
+			}
+		}
+	}
+}
+
+func TestFingerprintAdded(t *testing.T) {
+	ctx := WithClient(context.Background(), "192.0.2.1", "phone")
+	manager := New(memory.New(), "app")
+	cookie := saveNewSession(t, manager)
+
+	// sessions created before fingerprinting was enabled are fingerprinted
+	// when they are next committed
+	manager.Fingerprint = UserAgentFamily
+	manager.FingerprintPolicy = FingerprintFlag
+	session, err := manager.Load(ctx, cookie)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	cookie, err = session.Commit(ctx)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := session.CookieChanged(), true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	_, err = manager.Load(WithClient(context.Background(), "192.0.2.1", "curl/7.64.1"), cookie)
+	if _, ok := err.(*FingerprintError); !ok {
+		t.Errorf("got=%v, want=*FingerprintError", err)
+	}
+}
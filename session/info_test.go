@@ -0,0 +1,91 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestSessionInfo(t *testing.T) {
+	defer restoreStubs()
+	ctx := context.Background()
+	fakeNow := time.Now().Truncate(time.Second)
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	db := memory.New().WithTimeNow(nowFunc)
+	manager := New(db, "app")
+	manager.IdleTimeout = 30 * time.Minute
+	manager.TouchInterval = 5 * time.Minute
+	createdAt := fakeNow
+
+	session := manager.NewSession()
+	session.Values["key"] = "value"
+	session.ClientIP = "192.0.2.1"
+	session.UserAgent = "phone"
+	cookie, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	rec, err := db.Fetch(ctx, testRecordID(t, manager, session.ID))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := rec.ClientIP, "192.0.2.1"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := rec.UserAgent, "phone"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := rec.LastSeenAt, createdAt; !got.Equal(want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// loading the session after the touch interval updates the last seen time
+	fakeNow = fakeNow.Add(10 * time.Minute)
+	session = loadSession(t, manager, cookie)
+	info := session.Info()
+	if got, want := info.CreatedAt, createdAt; !got.Equal(want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.LastSeenAt, fakeNow; !got.Equal(want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.ExpiresAt, fakeNow.Add(manager.IdleTimeout); !got.Equal(want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.ClientIP, "192.0.2.1"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// a new client IP address is saved even though the values are unchanged
+	session.ClientIP = "198.51.100.1"
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	info, err = manager.LookupSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if info == nil {
+		t.Fatal("got=nil, want=session info")
+	}
+	if got, want := info.ClientIP, "198.51.100.1"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := info.UserAgent, "phone"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// expired sessions are not found
+	fakeNow = fakeNow.Add(time.Hour)
+	info, err = manager.LookupSession(ctx, session.ID)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if info != nil {
+		t.Errorf("got=%v, want=nil", info)
+	}
+}
@@ -0,0 +1,156 @@
+package session
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+)
+
+// sessionKey returns the key used to identify the session with ID sid in
+// persistent storage. This is the session ID, unless the manager has HashIDs
+// set, in which case it is the hex-encoded HMAC of the session ID.
+func (m *Manager) sessionKey(ctx context.Context, sid string) (string, error) {
+	if !m.HashIDs {
+		return sid, nil
+	}
+	mac, err := m.Codec.MAC(ctx, []byte(sid))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot hash session id")
+	}
+	return hex.EncodeToString(mac), nil
+}
+
+// SessionKey returns the key that identifies the session with ID sid in persistent
+// storage. This is the session ID, unless the manager has HashIDs set, in which case
+// it is the keyed hash of the session ID. Session keys are reported in the ID field
+// of UserSession and in events, and are accepted by RevokeSession.
+func (m *Manager) SessionKey(ctx context.Context, sid string) (string, error) {
+	return m.sessionKey(ctx, sid)
+}
+
+// RevokeSession deletes the session identified by its session key, along with any
+// binding between the session and a user. See SessionKey.
+func (m *Manager) RevokeSession(ctx context.Context, key string) error {
+	if err := m.DB.Delete(ctx, m.keyRecordID(key)); err != nil {
+		return errors.Wrap(err, "cannot delete session")
+	}
+	if err := m.DB.Delete(ctx, m.userEntryID(key)); err != nil {
+		return errors.Wrap(err, "cannot delete user binding")
+	}
+	m.send(ctx, &Event{Type: EventDestroyed, SessionID: key, Reason: "revoked"})
+	return nil
+}
+
+// fetchSession fetches the record for the session with ID sid. If the manager has
+// HashIDs set and the record is not found, then it looks for a record stored using
+// the session ID. If found, the record is moved so that it is stored using the
+// hashed session ID, along with any binding between the session and a user.
+func (m *Manager) fetchSession(ctx context.Context, sid string) (*storage.Record, error) {
+	key, err := m.sessionKey(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	recordID := m.keyRecordID(key)
+	rec, err := m.DB.Fetch(ctx, recordID)
+	if err != nil || rec != nil || !m.HashIDs {
+		return rec, err
+	}
+
+	rawID := m.keyRecordID(sid)
+	rec, err = m.DB.Fetch(ctx, rawID)
+	if err != nil || rec == nil || rec.Format == tombstoneFormat {
+		// tombstones are not moved, as they expire soon
+		return rec, err
+	}
+	moved := *rec
+	moved.ID = recordID
+	moved.Version = 1
+	if err := m.DB.Save(ctx, &moved, 0); err != nil {
+		if err != storage.ErrVersionConflict {
+			return nil, errors.Wrap(err, "cannot move session record").With("id", rawID)
+		}
+		// another request has moved the record
+		return m.DB.Fetch(ctx, recordID)
+	}
+	if err := m.moveUserBinding(ctx, sid, key); err != nil {
+		return nil, err
+	}
+	if err := m.DB.Delete(ctx, rawID); err != nil {
+		return nil, errors.Wrap(err, "cannot delete moved session record").With("id", rawID)
+	}
+	return &moved, nil
+}
+
+// moveUserBinding moves the binding between a user and the session whose record
+// has been moved from the session key oldKey to newKey, so that the session is
+// still found by ListUserSessions and RevokeUserSessions. The new binding is saved,
+// and the user's index record updated, before the old binding is deleted.
+func (m *Manager) moveUserBinding(ctx context.Context, oldKey string, newKey string) error {
+	oldID := m.userEntryID(oldKey)
+	rec, err := m.DB.Fetch(ctx, oldID)
+	if err != nil {
+		return errors.Wrap(err, "cannot fetch user binding").With("id", oldID)
+	}
+	if rec == nil {
+		return nil
+	}
+	entry, err := decodeUserEntry(rec)
+	if err != nil {
+		return errors.Wrap(err, "cannot decode user binding").With("id", oldID)
+	}
+	errors := errors.With("user", entry.UserID)
+	entry.SessionID = newKey
+	moved := *rec
+	moved.ID = m.userEntryID(newKey)
+	if moved.Data, err = encodeGob(entry); err != nil {
+		return err
+	}
+	if err := m.DB.Save(ctx, &moved, -1); err != nil {
+		return errors.Wrap(err, "cannot move user binding")
+	}
+	if _, ok := m.DB.(storage.Indexer); !ok {
+		err := m.updateUserIndex(ctx, entry.UserID, func(sids []string) ([]string, error) {
+			for i, sid := range sids {
+				if sid == oldKey {
+					sids[i] = newKey
+				}
+			}
+			return sids, nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "cannot update user index")
+		}
+	}
+	if err := m.DB.Delete(ctx, oldID); err != nil {
+		return errors.Wrap(err, "cannot delete moved user binding")
+	}
+	return nil
+}
+
+// tombstoneData returns the data for a tombstone record, which identifies the
+// new session ID. If the manager has HashIDs set, the new session ID is encrypted
+// so that it cannot be read from storage.
+func (m *Manager) tombstoneData(sid sessionID) ([]byte, error) {
+	if !m.HashIDs {
+		return []byte(sid.String()), nil
+	}
+	encoded, err := m.Codec.Encode(tombstoneFormat, sid)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode tombstone")
+	}
+	return []byte(encoded), nil
+}
+
+// tombstoneSessionID returns the new session ID from a tombstone record.
+func (m *Manager) tombstoneSessionID(rec *storage.Record) (string, error) {
+	if sid, err := parseSessionID(string(rec.Data)); err == nil {
+		return sid.String(), nil
+	}
+	var sid sessionID
+	if err := m.Codec.Decode(tombstoneFormat, string(rec.Data), &sid); err != nil {
+		return "", errors.Wrap(err, "cannot decode tombstone").With("id", rec.ID)
+	}
+	return sid.String(), nil
+}
@@ -0,0 +1,196 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestHashIDs(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	manager := New(db, "app")
+	manager.HashIDs = true
+	cookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, cookie)
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// record is not stored using the session ID
+	rec, err := db.Fetch(ctx, manager.keyRecordID(session.ID))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec != nil {
+		t.Errorf("got=%v, want=nil", rec)
+	}
+	id := testRecordID(t, manager, session.ID)
+	if id == manager.keyRecordID(session.ID) {
+		t.Errorf("want hashed record ID")
+	}
+	rec, err = db.Fetch(ctx, id)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec == nil {
+		t.Fatal("got=nil, want=non-nil")
+	}
+}
+
+func TestHashIDsMigration(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	manager := New(db, "app")
+	cookie := saveNewSession(t, manager)
+	sid := loadSession(t, manager, cookie).ID
+
+	// record stored using the session ID is found and moved
+	manager.HashIDs = true
+	session := loadSession(t, manager, cookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.ID, sid; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	rec, err := db.Fetch(ctx, manager.keyRecordID(sid))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec != nil {
+		t.Errorf("got=%v, want=nil", rec)
+	}
+	rec, err = db.Fetch(ctx, testRecordID(t, manager, sid))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec == nil {
+		t.Fatal("got=nil, want=non-nil")
+	}
+
+	// moved record can be saved and loaded again
+	session.Values["key"] = "changed"
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	session = loadSession(t, manager, cookie)
+	if got, want := session.Values["key"], "changed"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestHashIDsMigrationUserSessions(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		db   storage.Provider
+	}{
+		{name: "indexer", db: memory.New()},
+		{name: "versioned", db: plainProvider{memory.New()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testHashIDsMigrationUserSessions(t, New(tt.db, "app"))
+		})
+	}
+}
+
+func testHashIDsMigrationUserSessions(t *testing.T, manager *Manager) {
+	ctx := context.Background()
+	session := loadSession(t, manager, "")
+	session.Values["key"] = "value"
+	if err := session.BindUser(ctx, "alice"); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	cookie, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	sid := session.ID
+
+	// the user binding is moved along with the session record
+	manager.HashIDs = true
+	if got, want := loadSession(t, manager, cookie).IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	list, err := manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := list[0].ID, testSessionKey(t, manager, sid); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	bound, err := manager.isBound(ctx, sid)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if !bound {
+		t.Errorf("got=false, want=true")
+	}
+
+	// the moved session is revoked
+	if err := manager.RevokeUserSessions(ctx, "alice"); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := loadSession(t, manager, cookie).IsNew, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	for _, id := range []string{testRecordID(t, manager, sid), manager.keyRecordID(sid)} {
+		rec, err := manager.DB.Fetch(ctx, id)
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if rec != nil {
+			t.Errorf("%s: got=%v, want=nil", id, rec)
+		}
+	}
+}
+
+func TestHashIDsTombstone(t *testing.T) {
+	ctx := context.Background()
+	db := memory.New()
+	manager := New(db, "app")
+	manager.HashIDs = true
+	manager.RegenerateGracePeriod = time.Minute
+	oldCookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, oldCookie)
+	oldID := session.ID
+
+	if _, err := session.RegenerateID(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	newID := session.ID
+
+	// tombstone does not contain the new session ID
+	rec, err := db.Fetch(ctx, testRecordID(t, manager, oldID))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec == nil {
+		t.Fatal("got=nil, want=non-nil")
+	}
+	if got, want := rec.Format, tombstoneFormat; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if bytes.Contains(rec.Data, []byte(newID)) {
+		t.Errorf("tombstone contains new session ID")
+	}
+
+	// old cookie loads the session with the new ID
+	session = loadSession(t, manager, oldCookie)
+	if got, want := session.ID, newID; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,162 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+)
+
+// SessionLimitPolicy determines what happens when a session is bound to a user
+// who already has the maximum number of sessions.
+type SessionLimitPolicy int
+
+// Session limit policies.
+const (
+	EvictOldest            SessionLimitPolicy = iota // revoke the user's oldest session
+	EvictLeastRecentlySeen                           // revoke the user's least recently seen session
+	RejectNewSession                                 // BindUser returns a *SessionLimitError
+)
+
+// SessionLimitError is the error returned by BindUser when the user already has
+// the maximum number of sessions, and the manager's session limit policy is
+// RejectNewSession. The session is not bound to the user.
+type SessionLimitError struct {
+	UserID string
+	Limit  int
+}
+
+// Error implements the error interface.
+func (e *SessionLimitError) Error() string {
+	return fmt.Sprintf("user already has %d sessions: %s", e.Limit, e.UserID)
+}
+
+// limitUserSessions adds the session key to the versioned index record for userID,
+// first making room for it by evicting the user's other sessions, or rejecting it,
+// depending on the manager's session limit policy. Concurrent calls for the same
+// user conflict when saving the index record, and are retried, so that the user
+// never ends up with more sessions than the limit.
+//
+// The index record is maintained even when the storage provider implements the
+// storage.Indexer interface, as it provides the version check.
+func (m *Manager) limitUserSessions(ctx context.Context, userID string, key string) error {
+	errors := errors.With("user", userID)
+	rec, err := m.DB.Fetch(ctx, m.userEntryID(key))
+	if err != nil {
+		return errors.Wrap(err, "cannot fetch user binding")
+	}
+	if rec != nil {
+		entry, err := decodeUserEntry(rec)
+		if err != nil {
+			return errors.Wrap(err, "cannot decode user binding")
+		}
+		if entry.UserID == userID {
+			// already bound to this user
+			return nil
+		}
+	}
+
+	var evicted []*UserSession
+	err = m.updateUserIndex(ctx, userID, func(sids []string) ([]string, error) {
+		active, err := m.activeUserSessions(ctx, userID, sids, key)
+		if err != nil {
+			return nil, err
+		}
+		evicted = nil
+		if excess := len(active) + 1 - m.MaxUserSessions; excess > 0 {
+			if m.SessionLimitPolicy == RejectNewSession {
+				return nil, &SessionLimitError{UserID: userID, Limit: m.MaxUserSessions}
+			}
+			if m.SessionLimitPolicy == EvictLeastRecentlySeen {
+				sort.SliceStable(active, func(i, j int) bool {
+					return active[i].LastSeenAt.Before(active[j].LastSeenAt)
+				})
+			}
+			evicted, active = active[:excess], active[excess:]
+		}
+		sids = sids[:0]
+		for _, us := range active {
+			sids = append(sids, us.ID)
+		}
+		return append(sids, key), nil
+	})
+	if err != nil {
+		if _, ok := err.(*SessionLimitError); ok {
+			return err
+		}
+		return errors.Wrap(err, "cannot update user index")
+	}
+
+	for _, us := range evicted {
+		// The user binding is deleted first, so that a session that has not
+		// been committed yet is deleted by Commit when it finds no binding.
+		if err := m.DB.Delete(ctx, m.userEntryID(us.ID)); err != nil {
+			return errors.Wrap(err, "cannot delete user binding")
+		}
+		if err := m.DB.Delete(ctx, m.keyRecordID(us.ID)); err != nil {
+			return errors.Wrap(err, "cannot delete evicted session")
+		}
+		m.send(ctx, &Event{Type: EventDestroyed, SessionID: us.ID, Reason: "session limit"})
+	}
+	return nil
+}
+
+// activeUserSessions returns the sessions that are bound to userID, other than the
+// session with session key, ordered by creation time. The sessions are those in
+// the index sids, and if the storage provider implements storage.Indexer, those
+// whose user bindings are indexed.
+func (m *Manager) activeUserSessions(ctx context.Context, userID string, sids []string, key string) ([]*UserSession, error) {
+	keys := make(map[string]bool) // value is true if in the index record
+	if _, ok := m.DB.(storage.Indexer); ok {
+		entries, err := m.userEntries(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			keys[entry.SessionID] = false
+		}
+	}
+	for _, sid := range sids {
+		keys[sid] = true
+	}
+	delete(keys, key)
+
+	now := nowFunc()
+	var active []*UserSession
+	for sid, indexed := range keys {
+		rec, err := m.DB.Fetch(ctx, m.userEntryID(sid))
+		if err != nil {
+			return nil, err
+		}
+		// A session in the index record without a user binding is being
+		// bound by a concurrent request, which saves the user binding after
+		// the index record, so it counts towards the limit if it exists.
+		entry := &userEntry{UserID: userID, SessionID: sid}
+		if rec != nil {
+			if entry, err = decodeUserEntry(rec); err != nil {
+				return nil, err
+			}
+		} else if !indexed {
+			continue
+		}
+		if entry.UserID != userID {
+			continue
+		}
+		us, err := m.userSession(ctx, entry, now)
+		if err != nil {
+			return nil, err
+		}
+		if us != nil {
+			active = append(active, us)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if active[i].CreatedAt.Equal(active[j].CreatedAt) {
+			return active[i].ID < active[j].ID
+		}
+		return active[i].CreatedAt.Before(active[j].CreatedAt)
+	})
+	return active, nil
+}
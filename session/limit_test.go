@@ -0,0 +1,214 @@
+package session
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestMaxUserSessions(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		db   func() storage.Provider
+	}{
+		{name: "indexer", db: func() storage.Provider { return memory.New() }},
+		{name: "versioned", db: func() storage.Provider { return plainProvider{memory.New()} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, policy := range []SessionLimitPolicy{EvictOldest, EvictLeastRecentlySeen, RejectNewSession} {
+				testMaxUserSessions(t, tt.db(), policy)
+			}
+		})
+	}
+}
+
+func testMaxUserSessions(t *testing.T, db storage.Provider, policy SessionLimitPolicy) {
+	defer restoreStubs()
+	ctx := context.Background()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	manager := New(db, "app")
+	manager.MaxUserSessions = 2
+	manager.SessionLimitPolicy = policy
+
+	// login saves a new session and binds it to alice
+	login := func() (*Session, error) {
+		fakeNow = fakeNow.Add(time.Minute)
+		session := manager.NewSession()
+		session.Values["key"] = "value"
+		if _, err := session.Commit(ctx); err != nil {
+			t.Fatalf("%d: got=%v, want=nil", policy, err)
+		}
+		return session, session.BindUser(ctx, "alice")
+	}
+	first, err := login()
+	if err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+	second, err := login()
+	if err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+
+	// binding again does not count towards the limit
+	if err := second.BindUser(ctx, "alice"); err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+
+	// use the first session, so that the second session is least recently seen
+	fakeNow = fakeNow.Add(time.Minute)
+	first.Values["key"] = "changed"
+	if _, err := first.Commit(ctx); err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+
+	third, err := login()
+	var want []*Session
+	switch policy {
+	case EvictOldest:
+		want = []*Session{second, third}
+	case EvictLeastRecentlySeen:
+		want = []*Session{first, third}
+	case RejectNewSession:
+		if _, ok := err.(*SessionLimitError); !ok {
+			t.Fatalf("%d: got=%v, want=*SessionLimitError", policy, err)
+		}
+		want = []*Session{first, second}
+	}
+	if policy != RejectNewSession && err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+
+	list, err := manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+	if got, want := len(list), len(want); got != want {
+		t.Fatalf("%d: got=%v, want=%v", policy, got, want)
+	}
+	for i, session := range want {
+		if got, want := list[i].ID, session.ID; got != want {
+			t.Errorf("%d: %d: got=%v, want=%v", policy, i, got, want)
+		}
+	}
+}
+
+func TestMaxUserSessionsConcurrent(t *testing.T) {
+	ctx := context.Background()
+	manager := New(plainProvider{memory.New()}, "app")
+	manager.MaxUserSessions = 3
+	manager.SessionLimitPolicy = RejectNewSession
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := manager.NewSession()
+			session.Values["key"] = "value"
+			if _, err := session.Commit(ctx); err != nil {
+				t.Errorf("got=%v, want=nil", err)
+				return
+			}
+			if err := session.BindUser(ctx, "alice"); err != nil {
+				if _, ok := err.(*SessionLimitError); !ok {
+					t.Errorf("got=%v, want=nil or *SessionLimitError", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	list, err := manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 3; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestMaxUserSessionsBeforeCommit(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		db   func() storage.Provider
+	}{
+		{name: "indexer", db: func() storage.Provider { return memory.New() }},
+		{name: "versioned", db: func() storage.Provider { return plainProvider{memory.New()} }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, policy := range []SessionLimitPolicy{EvictOldest, EvictLeastRecentlySeen, RejectNewSession} {
+				testMaxUserSessionsBeforeCommit(t, tt.db(), policy)
+			}
+		})
+	}
+}
+
+func testMaxUserSessionsBeforeCommit(t *testing.T, db storage.Provider, policy SessionLimitPolicy) {
+	defer restoreStubs()
+	ctx := context.Background()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	manager := New(db, "app")
+	manager.MaxUserSessions = 1
+	manager.SessionLimitPolicy = policy
+
+	// two logins interleave, each binding its session before committing it
+	a := manager.NewSession()
+	a.Values["key"] = "a"
+	if err := a.BindUser(ctx, "alice"); err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+	fakeNow = fakeNow.Add(time.Second)
+	b := manager.NewSession()
+	b.Values["key"] = "b"
+	errB := b.BindUser(ctx, "alice")
+	_, errA := a.Commit(ctx)
+	var want *Session
+	if policy == RejectNewSession {
+		if _, ok := errB.(*SessionLimitError); !ok {
+			t.Fatalf("%d: got=%v, want=*SessionLimitError", policy, errB)
+		}
+		if errA != nil {
+			t.Fatalf("%d: got=%v, want=nil", policy, errA)
+		}
+		want = a
+	} else {
+		if errB != nil {
+			t.Fatalf("%d: got=%v, want=nil", policy, errB)
+		}
+		if errA == nil {
+			t.Fatalf("%d: got=nil, want=error", policy)
+		}
+		if _, err := b.Commit(ctx); err != nil {
+			t.Fatalf("%d: got=%v, want=nil", policy, err)
+		}
+		rec, err := db.Fetch(ctx, testRecordID(t, manager, a.ID))
+		if err != nil {
+			t.Fatalf("%d: got=%v, want=nil", policy, err)
+		}
+		if rec != nil {
+			t.Errorf("%d: got=%v, want=nil", policy, rec.ID)
+		}
+		want = b
+	}
+
+	list, err := manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("%d: got=%v, want=nil", policy, err)
+	}
+	if got, want := len(list), 1; got != want {
+		t.Fatalf("%d: got=%v, want=%v", policy, got, want)
+	}
+	if got, want := list[0].ID, testSessionKey(t, manager, want.ID); got != want {
+		t.Errorf("%d: got=%v, want=%v", policy, got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestOptimisticLocking(t *testing.T) {
+	manager := New(memory.New(), "")
+	manager.OptimisticLocking = true
+	cookie := saveNewSession(t, manager)
+
+	session1 := loadSession(t, manager, cookie)
+	session2 := loadSession(t, manager, cookie)
+
+	session1.Values["one"] = 1
+	if _, err := session1.Commit(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	// session1 can be saved again, as it has the latest version
+	session1.Values["one"] = 11
+	if _, err := session1.Commit(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	session2.Values["two"] = 2
+	_, err := session2.Commit(context.Background())
+	if err == nil {
+		t.Fatal("got=nil, want=non-nil")
+	}
+	if conflict, ok := err.(*ConflictError); !ok {
+		t.Fatalf("got=%T, want=*ConflictError", err)
+	} else if got, want := conflict.Name, defaultName; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	session := loadSession(t, manager, cookie)
+	if got, want := session.Values["one"], 11; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["two"], interface{}(nil); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestOptimisticLockingMerge(t *testing.T) {
+	manager := New(memory.New(), "")
+	manager.OptimisticLocking = true
+	var mergeCount int
+	manager.Merge = func(base, mine, theirs map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+		mergeCount++
+		if _, ok := base["one"]; ok {
+			t.Errorf("unexpected value in base")
+		}
+		for k, v := range theirs {
+			if _, ok := mine[k]; !ok {
+				mine[k] = v
+			}
+		}
+		return mine, nil
+	}
+	cookie := saveNewSession(t, manager)
+
+	session1 := loadSession(t, manager, cookie)
+	session2 := loadSession(t, manager, cookie)
+
+	session1.Values["one"] = 1
+	if _, err := session1.Commit(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	session2.Values["two"] = 2
+	if _, err := session2.Commit(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := mergeCount, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session2.Values["one"], 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	session := loadSession(t, manager, cookie)
+	if got, want := session.Values["one"], 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["two"], 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestOptimisticLockingUnversioned(t *testing.T) {
+	db := &countingProvider{Provider: memory.New()}
+	testOptimisticLockingUnversioned(t, db)
+	if got, want := db.deleteCount, 0; got != want {
+		t.Errorf("deleteCount: got=%v, want=%v", got, want)
+	}
+
+	// provider that does not implement storage.Upgrader
+	testOptimisticLockingUnversioned(t, plainProvider{memory.New()})
+}
+
+func testOptimisticLockingUnversioned(t *testing.T, db storage.Provider) {
+	manager := New(db, "")
+	cookie := saveNewSession(t, manager)
+
+	// turn on optimistic locking for a session saved without a version
+	manager.OptimisticLocking = true
+	session := loadSession(t, manager, cookie)
+	other := loadSession(t, manager, cookie)
+	session.Values["key"] = "new value"
+	if _, err := session.Commit(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	// another request that loaded the unversioned session conflicts
+	other.Values["key"] = "other value"
+	_, err := other.Commit(context.Background())
+	if _, ok := err.(*ConflictError); !ok {
+		t.Errorf("got=%v, want=*ConflictError", err)
+	}
+
+	session = loadSession(t, manager, cookie)
+	if got, want := session.Values["key"], "new value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.state.version, int64(1); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,676 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/codec"
+	"github.com/jjeffery/sessions/storage"
+)
+
+const (
+	// tombstoneFormat is the record format used for the record of a session
+	// whose ID has been regenerated. The record data contains the new session ID.
+	tombstoneFormat = "tombstone"
+
+	// defaultName is the cookie name used if the manager does not have a name.
+	defaultName = "session"
+)
+
+var (
+	nowFunc           = time.Now
+	randRead          = rand.Read
+	errEmptySessionID = errors.New("empty session id")
+)
+
+type sessionID [16]byte
+
+func newSessionID() (sessionID, error) {
+	var sid sessionID
+	if _, err := randRead(sid[:]); err != nil {
+		return sid, err
+	}
+	return sid, nil
+}
+
+func (sid sessionID) String() string {
+	str := hex.EncodeToString(sid[:])
+	return str
+}
+
+func parseSessionID(str string) (sessionID, error) {
+	var sid sessionID
+	if str == "" {
+		// empty session IDs are expected, so detect and error quickly
+		return sid, errEmptySessionID
+	}
+	n, err := hex.Decode(sid[:], []byte(str))
+	if err != nil {
+		return sid, err
+	}
+	if n < len(sid) {
+		return sid, fmt.Errorf("sessionID too small len=%d", n)
+	}
+	return sid, nil
+}
+
+// Manager loads and commits sessions, which are persisted using a storage provider.
+//
+// The Manager automatically generates and persists random secret keying material
+// that is used for generating the keys used to sign and encrypt the secure session
+// cookies. The secret keying material is regularly rotated.
+//
+// By default each session record expires at a fixed time after it was last saved,
+// based on the session's MaxAge. If IdleTimeout is set, sessions use sliding expiration
+// instead: the session record expires when the session has not been used for the
+// idle timeout. Each time a session is loaded, its expiry time is extended by
+// calling the storage provider's Touch method, which does not rewrite the session
+// data. To reduce the number of writes, the expiry time is only extended if it
+// would move by at least TouchInterval, or if the session was last seen at least
+// TouchInterval ago. If TouchInterval is zero, then one tenth
+// of the idle timeout is used. If the storage provider does not implement the
+// storage.Toucher interface, the expiry time is only extended when the session
+// is committed.
+//
+// If AbsoluteTimeout is set, a session expires at this time after it was created,
+// regardless of how recently it has been used.
+//
+// Each session record includes the time the session was created, the time it was
+// last seen, and the client IP address and user agent of the session's ClientIP
+// and UserAgent fields. The last seen time is updated whenever the record is written
+// or touched, so it is accurate to within the touch interval. See SessionInfo.
+//
+// When a session is committed, the session record is only written to storage if the
+// session values have changed since the session was loaded. Similarly, the session
+// cookie only needs to be sent if it has been re-encoded, which happens when the
+// session ID has changed, when the secret keying material has been rotated, or when
+// the cookie is more than half way through its maximum age.
+//
+// If OptimisticLocking is set, session records are saved with a version check,
+// so that changes made by concurrent requests for the same session are not
+// silently lost. If the session record has been modified since it was loaded,
+// and Merge is nil, then Commit returns a *ConflictError. If Merge is not nil,
+// it is called to merge the changes, and the merged values are saved. Records
+// saved before OptimisticLocking was set are replaced with versioned records,
+// which is only atomic if the storage provider implements storage.Upgrader.
+//
+// When a session ID is regenerated, the record for the old session ID is deleted.
+// If RegenerateGracePeriod is set, the old record is instead replaced with a
+// tombstone record that expires after the grace period. Requests that are still
+// using the old session cookie during the grace period will load the session
+// using its new ID, but will not be sent the new session cookie.
+//
+// Session values are serialized using Serializer, or encoding/gob if Serializer
+// is nil. The format of each session record is saved with the record, so session
+// records saved in another format can still be loaded, provided that the format
+// is one of the built-in formats. Session records are re-saved using Serializer
+// the next time that they are saved.
+//
+// If HashIDs is set, session records are stored using an HMAC-SHA256 hash of the
+// session ID instead of the session ID itself, so that the contents of the storage
+// cannot be used to create a session cookie. The hash key is persisted with the
+// codec's secret keying material. Session records that were stored using the
+// session ID are still found, and are moved to the hashed ID when loaded.
+//
+// If CookieValuesThreshold is set, the session values are kept in the session
+// cookie instead of in a session record, provided that the encoded cookie value
+// is no larger than the threshold. Loading these sessions does not require any
+// storage access. Once the session values grow too large, they are saved in a
+// session record, and if they shrink again they are moved back into the cookie.
+// Browsers limit cookies to around 4096 bytes including the cookie name and
+// attributes, so the threshold should be somewhat smaller than this. Sessions
+// kept in the cookie cannot be revoked, so a session that is bound to a user
+// (see Session.BindUser) is always kept in a session record. Optimistic locking
+// does not apply to sessions kept in the cookie.
+//
+// If Events is set, it receives an Event whenever a session is created, loaded,
+// saved, regenerated, destroyed or revoked, and whenever a session cookie cannot
+// be decoded or refers to a session that has expired. This provides an audit trail
+// of logins and logouts that does not depend on application code. See SlogSink
+// for an event sink that logs events.
+//
+// If Fingerprint is set, a fingerprint of the client is recorded when each session
+// is created, and is checked each time the session is loaded. The client's IP address
+// and user agent are identified by calling Load with a context returned by WithClient,
+// and ClientIPPrefix, UserAgentFamily and CombineFingerprints are provided for building
+// fingerprints. The fingerprint is kept in the encrypted session cookie, so a client
+// cannot change it, and a stolen cookie used by another client will not match. What
+// happens when the fingerprint does not match depends on FingerprintPolicy. Note that
+// a session's fingerprint is recorded again when its ID is regenerated.
+//
+// If MaxUserSessions is set, it limits the number of sessions that can be bound to
+// each user by Session.BindUser. When binding another session would exceed the limit,
+// SessionLimitPolicy determines whether one of the user's existing sessions is
+// revoked to make room, or whether BindUser returns a *SessionLimitError. The
+// limit is enforced using a versioned index record for each user, so concurrent
+// logins by the same user cannot exceed it.
+//
+// If Degradation is set, sessions continue to work when the storage provider is
+// unavailable, for example during a database failover. Depending on the policy,
+// sessions that cannot be loaded are anonymous and read-only, and sessions that
+// cannot be saved are kept in memory until the storage provider recovers. See
+// Degradation and Session.Degraded.
+//
+// While all fields are public, they should not be modified once the manager is in use.
+type Manager struct {
+	DB    storage.Provider
+	Codec *codec.Codec
+	AppID string // set if multiple apps share the same storage provider
+	Name  string // cookie name, used when encoding cookies, "session" if empty
+
+	MaxAge time.Duration // default session lifetime, 24 hours if zero
+
+	Serializer Serializer // serializes session values, gob if nil
+
+	IdleTimeout     time.Duration // enables sliding expiration if non-zero
+	AbsoluteTimeout time.Duration // maximum session lifetime if non-zero
+	TouchInterval   time.Duration // minimum extension of the expiry time by Touch
+
+	OptimisticLocking bool      // check versions when saving session records
+	Merge             MergeFunc // merges concurrent changes if optimistic locking
+
+	RegenerateGracePeriod time.Duration // old session ID remains valid after regeneration
+
+	HashIDs bool // store session records using a keyed hash of the session ID
+
+	CookieValuesThreshold int // maximum size of a cookie containing session values
+
+	Events EventSink // receives session lifecycle events if not nil
+
+	Fingerprint       FingerprintFunc   // fingerprints the client of each session if not nil
+	FingerprintPolicy FingerprintPolicy // what to do when the client fingerprint does not match
+
+	MaxUserSessions    int                // maximum sessions bound to each user if non-zero
+	SessionLimitPolicy SessionLimitPolicy // what to do when a user has too many sessions
+
+	Degradation *Degradation // what to do when storage is unavailable, fail if nil
+}
+
+// MergeFunc is a function that merges concurrent changes to session values.
+// The base values are the values when the session was loaded, mine are the values
+// that are being saved, and theirs are the values that were saved by another
+// request since the session was loaded. It returns the values to be saved.
+//
+// A merge function should not modify base or theirs, but it can modify
+// and return mine.
+type MergeFunc func(base, mine, theirs map[interface{}]interface{}) (map[interface{}]interface{}, error)
+
+// ConflictError is the error returned by Session.Commit when optimistic locking
+// is enabled and the session has been modified by another request since it
+// was loaded.
+type ConflictError struct {
+	Name string // session name
+}
+
+// Error implements the error interface.
+func (e *ConflictError) Error() string {
+	return "session modified by another request: " + e.Name
+}
+
+// New creates a new manager suitable for persisting sessions. Session data
+// is persisted using db. If multiple applications use the same provider
+// (eg the same database table), then each application should use a different
+// appid so that they generate and rotate their own, independent secret
+// keying material.
+func New(db storage.Provider, appid string) *Manager {
+	return &Manager{
+		DB:    db,
+		AppID: appid,
+		Codec: &codec.Codec{
+			DB:       db,
+			SecretID: appid + "_secrets",
+		},
+	}
+}
+
+// Load returns the session for the session cookie value. If cookieValue is empty,
+// or if the session has expired or been deleted, then a new session is returned.
+// If ctx was returned by WithClient, the session's ClientIP and UserAgent are set.
+//
+// Note that Load never returns a nil session, even in the case of an error. This
+// means that the caller can choose to continue with a new session if the cookie
+// cannot be decoded.
+func (m *Manager) Load(ctx context.Context, cookieValue string) (*Session, error) {
+	session := m.NewSession()
+	setClient(ctx, session)
+	if cookieValue == "" {
+		return session, nil
+	}
+	if err := m.Codec.Refresh(ctx); err != nil {
+		err = errors.Wrap(err, "cannot refresh codec")
+		if m.storageFailed(ctx, "load", err) {
+			return m.degradedSession(ctx, cookieValue), nil
+		}
+		return session, err
+	}
+	payload, info, err := m.decodeCookie(cookieValue)
+	if err != nil {
+		m.emit(ctx, &Event{Type: EventDecodeFailed, Reason: err.Error()})
+		err = errors.Wrap(err, "cannot decode cookie")
+		return session, err
+	}
+	session.cookieValue = cookieValue
+	if payload.Kind == payloadValues {
+		// session values are in the cookie
+		if err := m.loadFromCookie(session, payload, info); err != nil {
+			return session, err
+		}
+		if session.ID == "" {
+			m.emit(ctx, &Event{Type: EventExpiredOnLoad, SessionID: payload.ID.String(), Reason: "expired"})
+			return session, nil
+		}
+		checked, err := m.checkFingerprint(ctx, session)
+		if checked == session {
+			m.emit(ctx, &Event{Type: EventLoaded, SessionID: session.ID, Reason: "cookie"})
+		}
+		return checked, err
+	}
+	sid, fp := payload.ID, payload.Fingerprint
+	session.ID = sid.String()
+	rec, err := m.fetchRecord(ctx, session.ID)
+	if err != nil {
+		if m.storageFailed(ctx, "load", err) {
+			return m.degradedSession(ctx, cookieValue), nil
+		}
+		return session, err
+	}
+	var viaTombstone bool
+	if rec != nil && rec.Format == tombstoneFormat {
+		// The session ID has been regenerated, and the grace period has not
+		// expired. Load the session using its new ID.
+		viaTombstone = true
+		session.ID, err = m.tombstoneSessionID(rec)
+		if err != nil {
+			return session, err
+		}
+		rec, err = m.fetchRecord(ctx, session.ID)
+		if err != nil {
+			if m.storageFailed(ctx, "load", err) {
+				return m.degradedSession(ctx, cookieValue), nil
+			}
+			return session, err
+		}
+		if rec != nil && rec.Format == tombstoneFormat {
+			// only follow one tombstone
+			rec = nil
+		}
+	}
+	if rec == nil {
+		// The session has expired or has been deleted, so start
+		// a new session with a new ID.
+		session.ID = ""
+		m.emit(ctx, &Event{Type: EventExpiredOnLoad, SessionID: sid.String(), Reason: "not found"})
+		return session, nil
+	}
+	now := nowFunc()
+	state := &sessionState{
+		sid:         session.ID,
+		saved:       true,
+		createdAt:   rec.CreatedAt,
+		expiresAt:   rec.ExpiresAt,
+		lastSeenAt:  rec.LastSeenAt,
+		clientIP:    rec.ClientIP,
+		userAgent:   rec.UserAgent,
+		version:     rec.Version,
+		format:      rec.Format,
+		data:        rec.Data,
+		fingerprint: fp,
+		bound:       payload.Bound,
+		cookie: cookieState{
+			sid:         session.ID,
+			issuedAt:    info.IssuedAt,
+			current:     info.Current,
+			bound:       payload.Bound,
+			legacy:      payload.legacy,
+			fingerprint: fp,
+		},
+		noCookie: viaTombstone,
+	}
+	if payload.legacy {
+		// The cookie does not record whether the session is bound to a user, so
+		// check once. The cookie is re-issued with the bound flag when committed.
+		if state.bound, err = m.isBound(ctx, session.ID); err != nil {
+			if m.storageFailed(ctx, "load", err) {
+				return m.degradedSession(ctx, cookieValue), nil
+			}
+			return session, err
+		}
+	}
+	if state.createdAt.IsZero() {
+		// record was saved before creation times were recorded
+		state.createdAt = now
+	}
+	if m.isExpired(state, now) {
+		// The storage provider has not deleted the expired record yet.
+		// Start a new session with a new ID.
+		if err := m.DB.Delete(ctx, rec.ID); err != nil && !m.storageFailed(ctx, "delete", err) {
+			return session, err
+		}
+		m.emit(ctx, &Event{Type: EventExpiredOnLoad, SessionID: session.ID, Reason: m.expiredReason(state, now)})
+		session.ID = ""
+		return session, nil
+	}
+	session.IsNew = false //  session data exists, so not new
+	if rec.Data != nil {
+		values, err := m.decodeValues(rec.Format, rec.Data)
+		if err != nil {
+			return session, err
+		}
+		session.Values = values
+	}
+	session.state = state
+	checked, fingerprintErr := m.checkFingerprint(ctx, session)
+	if checked != session {
+		// session destroyed
+		return checked, fingerprintErr
+	}
+	if _, ok := fingerprintErr.(*FingerprintError); fingerprintErr != nil && !ok {
+		return session, fingerprintErr
+	}
+	if m.IdleTimeout > 0 {
+		if err := m.touch(ctx, session, state, now); err != nil && !m.storageFailed(ctx, "touch", err) {
+			err = errors.Wrap(err, "cannot extend session expiry")
+			return session, err
+		}
+	}
+	event := &Event{Type: EventLoaded, SessionID: session.ID}
+	if viaTombstone {
+		event.Reason = "regenerated"
+	}
+	m.emit(ctx, event)
+	return session, fingerprintErr
+}
+
+// LookupSession returns metadata about the session with ID sid, or nil if the
+// session does not exist or has expired. It does not load the session values, and
+// it does not extend the session's expiry time. Sessions whose values are kept in
+// the session cookie cannot be found.
+func (m *Manager) LookupSession(ctx context.Context, sid string) (*SessionInfo, error) {
+	if _, err := parseSessionID(sid); err != nil {
+		return nil, nil
+	}
+	rec, err := m.fetchSession(ctx, sid)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil || rec.Format == tombstoneFormat {
+		return nil, nil
+	}
+	state := &sessionState{
+		createdAt: rec.CreatedAt,
+		expiresAt: rec.ExpiresAt,
+	}
+	if m.isExpired(state, nowFunc()) {
+		return nil, nil
+	}
+	info := &SessionInfo{
+		ID:         sid,
+		CreatedAt:  rec.CreatedAt,
+		LastSeenAt: rec.LastSeenAt,
+		ExpiresAt:  rec.ExpiresAt,
+		ClientIP:   rec.ClientIP,
+		UserAgent:  rec.UserAgent,
+	}
+	return info, nil
+}
+
+// NewSession returns a new, empty session. The session is not saved until it
+// is committed.
+func (m *Manager) NewSession() *Session {
+	return &Session{
+		Values:  make(map[interface{}]interface{}),
+		IsNew:   true,
+		MaxAge:  m.MaxAge,
+		manager: m,
+	}
+}
+
+// name returns the cookie name.
+func (m *Manager) name() string {
+	if m.Name == "" {
+		return defaultName
+	}
+	return m.Name
+}
+
+// isModified reports whether the session values have been modified since the
+// session was loaded or last saved. The session is also considered modified if
+// it was saved using a different serializer, so that it is saved again using the
+// manager's serializer.
+func (m *Manager) isModified(session *Session, state *sessionState) bool {
+	if state.format != m.serializer().Format() {
+		return true
+	}
+	values, err := m.decodeValues(state.format, state.data)
+	if err != nil {
+		return true
+	}
+
+	// Serialize and deserialize the current values, because the serializer
+	// may not preserve their types. For example JSON numbers are always float64.
+	format, data, err := m.encodeValues(session.Values)
+	if err != nil {
+		// Commit will report the error
+		return true
+	}
+	current, err := m.decodeValues(format, data)
+	if err != nil {
+		return true
+	}
+	return !reflect.DeepEqual(values, current)
+}
+
+// needsCookie reports whether the session cookie needs to be re-encoded.
+func (m *Manager) needsCookie(session *Session, state *sessionState, now time.Time) bool {
+	cookie := &state.cookie
+	if cookie.issuedAt.IsZero() || !cookie.current || cookie.values != state.inCookie {
+		return true
+	}
+	if cookie.sid != session.ID || cookie.fingerprint != state.fingerprint {
+		return true
+	}
+	if cookie.legacy || cookie.bound != state.bound {
+		return true
+	}
+
+	// re-issue the cookie when it is half way through its maximum age
+	maxAge := m.Codec.MaxAgeFor(m.name())
+	if session.MaxAge > 0 && session.MaxAge < maxAge {
+		maxAge = session.MaxAge
+	}
+	return now.Sub(cookie.issuedAt) > maxAge/2
+}
+
+// maxMergeAttempts is the number of times that Commit will attempt to
+// merge concurrent changes before returning a *ConflictError.
+const maxMergeAttempts = 5
+
+// saveVersioned saves the session record using optimistic locking. If the
+// record has been modified since it was loaded, the changes are merged
+// using the merge function.
+func (m *Manager) saveVersioned(ctx context.Context, session *Session, state *sessionState, rec *storage.Record) error {
+	expectVersion := state.version
+	// The record was saved without a version, so it is replaced with a
+	// versioned record. If another request replaces it first, this is
+	// a version conflict.
+	upgrade := expectVersion == 0 && state.saved
+
+	for attempt := 1; ; attempt++ {
+		rec.Version = expectVersion + 1
+		var err error
+		if upgrade {
+			err = m.upgradeRecord(ctx, rec)
+		} else {
+			err = m.DB.Save(ctx, rec, expectVersion)
+		}
+		if err == nil {
+			state.version = rec.Version
+			return nil
+		}
+		if err != storage.ErrVersionConflict {
+			return err
+		}
+		if m.Merge == nil || attempt >= maxMergeAttempts {
+			return &ConflictError{Name: m.name()}
+		}
+		current, err := m.DB.Fetch(ctx, rec.ID)
+		if err != nil {
+			return err
+		}
+		if current == nil || current.Format == tombstoneFormat {
+			// the session has been deleted or regenerated by another request
+			return &ConflictError{Name: m.name()}
+		}
+		base, err := m.decodeValues(state.format, state.data)
+		if err != nil {
+			return err
+		}
+		theirs, err := m.decodeValues(current.Format, current.Data)
+		if err != nil {
+			return err
+		}
+		merged, err := m.Merge(base, session.Values, theirs)
+		if err != nil {
+			return errors.Wrap(err, "cannot merge session values")
+		}
+		if rec.Format, rec.Data, err = m.encodeValues(merged); err != nil {
+			return err
+		}
+		session.Values = merged
+		state.format = current.Format
+		state.data = current.Data
+		state.version = current.Version
+		expectVersion = current.Version
+		upgrade = current.Version == 0
+	}
+}
+
+// upgradeRecord replaces the unversioned record with the same ID as rec with
+// the versioned record rec. If the storage provider does not implement the
+// storage.Upgrader interface, the record is fetched to check that it is still
+// unversioned, then deleted, and rec is inserted. This is not atomic, so the
+// storage provider should implement storage.Upgrader.
+func (m *Manager) upgradeRecord(ctx context.Context, rec *storage.Record) error {
+	if upgrader, ok := m.DB.(storage.Upgrader); ok {
+		return upgrader.Upgrade(ctx, rec)
+	}
+	current, err := m.DB.Fetch(ctx, rec.ID)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Version != 0 {
+		return storage.ErrVersionConflict
+	}
+	if err := m.DB.Delete(ctx, rec.ID); err != nil {
+		return err
+	}
+	return m.DB.Save(ctx, rec, 0)
+}
+
+// expiresAt returns the time that the session record should expire
+// if it is saved or touched at time now.
+func (m *Manager) expiresAt(session *Session, state *sessionState, now time.Time) time.Time {
+	expiresAt := now.Add(m.expiresIn(session))
+	if m.AbsoluteTimeout > 0 {
+		deadline := state.createdAt.Add(m.AbsoluteTimeout)
+		if expiresAt.After(deadline) {
+			expiresAt = deadline
+		}
+	}
+	return expiresAt
+}
+
+// expiresIn returns the duration after which an unused session record expires.
+func (m *Manager) expiresIn(session *Session) time.Duration {
+	if m.IdleTimeout > 0 {
+		return m.IdleTimeout
+	}
+	expiresIn := session.MaxAge
+	if expiresIn <= 0 {
+		expiresIn = time.Hour * 24
+	}
+	return expiresIn
+}
+
+// isExpired reports whether the session has expired at time now.
+func (m *Manager) isExpired(state *sessionState, now time.Time) bool {
+	if !state.expiresAt.IsZero() && state.expiresAt.Before(now) {
+		return true
+	}
+	if m.AbsoluteTimeout > 0 && state.createdAt.Add(m.AbsoluteTimeout).Before(now) {
+		return true
+	}
+	return false
+}
+
+// expiredReason returns the reason that an expired session has expired.
+func (m *Manager) expiredReason(state *sessionState, now time.Time) string {
+	if m.AbsoluteTimeout > 0 && state.createdAt.Add(m.AbsoluteTimeout).Before(now) {
+		return "absolute timeout"
+	}
+	if m.IdleTimeout > 0 {
+		return "idle timeout"
+	}
+	return "expired"
+}
+
+// touch extends the expiry time and updates the last seen time of the session
+// record if either would change by at least the touch interval.
+func (m *Manager) touch(ctx context.Context, session *Session, state *sessionState, now time.Time) error {
+	toucher, ok := m.DB.(storage.Toucher)
+	if !ok {
+		return nil
+	}
+	expiresAt := m.expiresAt(session, state, now)
+	interval := m.touchInterval(session)
+	if expiresAt.Sub(state.expiresAt) < interval && now.Sub(state.lastSeenAt) < interval {
+		// neither the expiry time nor the last seen time is stale enough
+		// to be worth a write
+		return nil
+	}
+	if err := m.storageAvailable(); err != nil {
+		return err
+	}
+	recordID, err := m.recordID(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+	if err := toucher.Touch(ctx, recordID, expiresAt, now); err != nil {
+		return err
+	}
+	state.expiresAt = expiresAt
+	state.lastSeenAt = now
+	return nil
+}
+
+// touchInterval returns the minimum duration that the expiry time of a
+// session is extended by.
+func (m *Manager) touchInterval(session *Session) time.Duration {
+	if m.TouchInterval > 0 {
+		return m.TouchInterval
+	}
+	return m.expiresIn(session) / 10
+}
+
+// recordID returns the unique ID for saving the record for session ID sid
+// to persistent storage.
+func (m *Manager) recordID(ctx context.Context, sid string) (string, error) {
+	key, err := m.sessionKey(ctx, sid)
+	if err != nil {
+		return "", err
+	}
+	return m.keyRecordID(key), nil
+}
+
+// keyRecordID returns the unique ID for saving the record with the specified key.
+func (m *Manager) keyRecordID(key string) string {
+	if m.AppID == "" {
+		return key
+	}
+	return m.AppID + "-" + key
+}
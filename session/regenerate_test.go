@@ -0,0 +1,87 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestRegenerateID(t *testing.T) {
+	manager := New(memory.New(), "app")
+	oldCookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, oldCookie)
+	oldID := session.ID
+
+	newCookie, err := session.RegenerateID(context.Background())
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if session.ID == oldID {
+		t.Fatalf("want different session ID")
+	}
+	if got, want := session.CookieChanged(), true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	session = loadSession(t, manager, newCookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// old cookie no longer works
+	session = loadSession(t, manager, oldCookie)
+	if got, want := session.IsNew, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestRegenerateIDGracePeriod(t *testing.T) {
+	defer restoreStubs()
+	fakeNow := time.Now()
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	manager := New(memory.New().WithTimeNow(nowFunc), "")
+	manager.RegenerateGracePeriod = 30 * time.Second
+	oldCookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, oldCookie)
+
+	if _, err := session.RegenerateID(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	newID := session.ID
+
+	// during the grace period, the old cookie loads the session with the new ID
+	fakeNow = fakeNow.Add(10 * time.Second)
+	session = loadSession(t, manager, oldCookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.ID, newID; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// changes are saved to the new session, but the new cookie is not sent
+	session.Values["key"] = "changed"
+	if _, err := session.Commit(context.Background()); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := session.CookieChanged(), false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// after the grace period, the old cookie no longer works
+	fakeNow = fakeNow.Add(30 * time.Second)
+	session = loadSession(t, manager, oldCookie)
+	if got, want := session.IsNew, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,281 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/jjeffery/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Serializer serializes session values for persistent storage.
+//
+// The format name is saved with each session record, and is used to choose the
+// serializer that deserializes the session values when the record is loaded.
+// This means that the serializer used by a manager can be changed, and sessions
+// that were saved using the previous serializer will still load.
+type Serializer interface {
+	// Format returns the name of the serialization format, which is saved
+	// in the Format field of each session record.
+	Format() string
+
+	// Serialize encodes the session values.
+	Serialize(values map[interface{}]interface{}) ([]byte, error)
+
+	// Deserialize decodes the session values.
+	Deserialize(data []byte) (map[interface{}]interface{}, error)
+}
+
+// ValueSerializer is an optional interface implemented by session serializers
+// that can also serialize individual values, such as struct values. All of the
+// built-in serializers implement ValueSerializer.
+type ValueSerializer interface {
+	// SerializeValue encodes v.
+	SerializeValue(v interface{}) ([]byte, error)
+
+	// DeserializeValue decodes data into the value pointed to by v.
+	DeserializeValue(data []byte, v interface{}) error
+}
+
+// builtinSerializers are used to deserialize session records, unless the format
+// matches the manager's serializer.
+var builtinSerializers = map[string]Serializer{
+	GobSerializer{}.Format():         GobSerializer{},
+	JSONSerializer{}.Format():        JSONSerializer{},
+	MessagePackSerializer{}.Format(): MessagePackSerializer{},
+}
+
+// GobSerializer serializes session values using encoding/gob. It is the
+// default serializer.
+//
+// As with Gorilla sessions, any custom types stored in the session values need
+// to be registered using gob.Register.
+type GobSerializer struct{}
+
+// Format implements the Serializer interface.
+func (GobSerializer) Format() string {
+	return "gob"
+}
+
+// Serialize implements the Serializer interface.
+func (gs GobSerializer) Serialize(values map[interface{}]interface{}) ([]byte, error) {
+	return gs.SerializeValue(values)
+}
+
+// Deserialize implements the Serializer interface.
+func (GobSerializer) Deserialize(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SerializeValue implements the ValueSerializer interface.
+func (GobSerializer) SerializeValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DeserializeValue implements the ValueSerializer interface.
+func (GobSerializer) DeserializeValue(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONSerializer serializes session values as a JSON object, which makes the
+// session records readable by programs that are not written in Go.
+//
+// All keys in the session values must be strings. When the session values are
+// deserialized, they have the types used by encoding/json when decoding into
+// an interface{}: for example numbers are float64. The exception is integers
+// outside the range ±2^53, which cannot be represented exactly by a float64,
+// and are int64 or uint64.
+type JSONSerializer struct{}
+
+// Format implements the Serializer interface.
+func (JSONSerializer) Format() string {
+	return "json"
+}
+
+// Serialize implements the Serializer interface.
+func (JSONSerializer) Serialize(values map[interface{}]interface{}) ([]byte, error) {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, errors.New("non-string key").With("key", fmt.Sprintf("%v", k))
+		}
+		m[ks] = v
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize implements the Serializer interface.
+func (JSONSerializer) Deserialize(data []byte) (map[interface{}]interface{}, error) {
+	var m map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{}, len(m))
+	for k, v := range m {
+		v, err := jsonNumbers(v)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = v
+	}
+	return values, nil
+}
+
+// maxExactFloat is the largest integer n such that all integers in the range
+// ±n can be represented exactly by a float64.
+const maxExactFloat = 1 << 53
+
+// jsonNumbers replaces the json.Number values in v, which has been decoded
+// using UseNumber, with float64 values, or with int64 or uint64 values for
+// integers that cannot be represented exactly by a float64.
+func jsonNumbers(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			if i < -maxExactFloat || i > maxExactFloat {
+				return i, nil
+			}
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		for k, e := range v {
+			if v[k], err = jsonNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if v[i], err = jsonNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// SerializeValue implements the ValueSerializer interface.
+func (JSONSerializer) SerializeValue(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// DeserializeValue implements the ValueSerializer interface.
+func (JSONSerializer) DeserializeValue(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MessagePackSerializer serializes session values using MessagePack
+// (https://msgpack.org), which is compact and readable by programs that
+// are not written in Go.
+//
+// When the session values are deserialized, they have the types used by
+// github.com/vmihailenco/msgpack when decoding into an interface{}: for
+// example integers have the smallest integer type that holds their value.
+type MessagePackSerializer struct{}
+
+// Format implements the Serializer interface.
+func (MessagePackSerializer) Format() string {
+	return "msgpack"
+}
+
+// Serialize implements the Serializer interface.
+func (MessagePackSerializer) Serialize(values map[interface{}]interface{}) ([]byte, error) {
+	return msgpack.Marshal(values)
+}
+
+// Deserialize implements the Serializer interface.
+func (MessagePackSerializer) Deserialize(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if err := msgpack.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// SerializeValue implements the ValueSerializer interface.
+func (MessagePackSerializer) SerializeValue(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// DeserializeValue implements the ValueSerializer interface.
+func (MessagePackSerializer) DeserializeValue(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// Format returns the name of the format used for serializing session values.
+func (m *Manager) Format() string {
+	return m.serializer().Format()
+}
+
+// ValueSerializer returns the value serializer for the specified format, which
+// is either the format of the manager's serializer or one of the built-in formats.
+func (m *Manager) ValueSerializer(format string) (ValueSerializer, error) {
+	serializer := m.serializer()
+	if serializer.Format() != format {
+		serializer = builtinSerializers[format]
+	}
+	vs, ok := serializer.(ValueSerializer)
+	if !ok {
+		return nil, errors.New("format does not support serializing values").With("format", format)
+	}
+	return vs, nil
+}
+
+// serializer returns the serializer used for saving session values.
+func (m *Manager) serializer() Serializer {
+	if m.Serializer == nil {
+		return GobSerializer{}
+	}
+	return m.Serializer
+}
+
+// encodeValues serializes session values, returning the format and the data.
+func (m *Manager) encodeValues(values map[interface{}]interface{}) (string, []byte, error) {
+	serializer := m.serializer()
+	data, err := serializer.Serialize(values)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "cannot encode session values").With("format", serializer.Format())
+	}
+	return serializer.Format(), data, nil
+}
+
+// decodeValues deserializes session values saved in the specified format. It
+// always returns a non-nil map if there is no error, even if data is empty.
+func (m *Manager) decodeValues(format string, data []byte) (map[interface{}]interface{}, error) {
+	errors := errors.With("format", format)
+	if len(data) == 0 {
+		return make(map[interface{}]interface{}), nil
+	}
+	serializer := m.serializer()
+	if serializer.Format() != format {
+		var ok bool
+		if serializer, ok = builtinSerializers[format]; !ok {
+			return nil, errors.New("unknown session format")
+		}
+	}
+	values, err := serializer.Deserialize(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode session values")
+	}
+	if values == nil {
+		values = make(map[interface{}]interface{})
+	}
+	return values, nil
+}
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestSerializers(t *testing.T) {
+	values := map[interface{}]interface{}{
+		"string": "value",
+		"number": 42.5,
+		"bool":   true,
+	}
+	for _, serializer := range []Serializer{
+		GobSerializer{},
+		JSONSerializer{},
+		MessagePackSerializer{},
+	} {
+		data, err := serializer.Serialize(values)
+		if err != nil {
+			t.Fatalf("%s: got=%v, want=nil", serializer.Format(), err)
+		}
+		got, err := serializer.Deserialize(data)
+		if err != nil {
+			t.Fatalf("%s: got=%v, want=nil", serializer.Format(), err)
+		}
+		if want := values; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got=%v, want=%v", serializer.Format(), got, want)
+		}
+	}
+
+	// JSON keeps integers that cannot be represented exactly by a float64
+	data, err := (JSONSerializer{}).Serialize(map[interface{}]interface{}{
+		"small":  int64(42),
+		"large":  int64(1<<53 + 1),
+		"nested": []interface{}{int64(-1<<62 - 1), uint64(1<<64 - 1)},
+	})
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	got, err := (JSONSerializer{}).Deserialize(data)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	want := map[interface{}]interface{}{
+		"small":  42.0,
+		"large":  int64(1<<53 + 1),
+		"nested": []interface{}{int64(-1<<62 - 1), uint64(1<<64 - 1)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// JSON requires string keys
+	if _, err := (JSONSerializer{}).Serialize(map[interface{}]interface{}{1: "one"}); err == nil {
+		t.Errorf("got=nil, want=non-nil")
+	}
+}
+
+func TestChangeSerializer(t *testing.T) {
+	ctx := context.Background()
+	db := &countingProvider{Provider: memory.New()}
+	manager := New(db, "")
+	cookie := saveNewSession(t, manager)
+
+	// session saved using gob loads after switching to JSON
+	manager.Serializer = JSONSerializer{}
+	session := loadSession(t, manager, cookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// session is saved using JSON, even though it has not changed
+	db.saveCount = 0
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := db.saveCount, 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	rec, err := db.Fetch(ctx, testRecordID(t, manager, session.ID))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := rec.Format, "json"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := string(rec.Data), `{"key":"value"}`; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// values that do not survive JSON unchanged are not considered modified
+	session = loadSession(t, manager, cookie)
+	session.Values["count"] = 1
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	db.saveCount = 0
+	session = loadSession(t, manager, cookie)
+	session.Values["count"] = 1
+	if _, err := session.Commit(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := db.saveCount, 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// unknown formats cannot be loaded
+	rec, err = db.Fetch(ctx, testRecordID(t, manager, session.ID))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	rec.Format = "unknown"
+	if err := db.Save(ctx, rec, -1); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if _, err := manager.Load(ctx, cookie); err == nil {
+		t.Errorf("got=nil, want=non-nil")
+	}
+}
@@ -0,0 +1,340 @@
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+)
+
+// Session contains the session values for a session loaded by a Manager.
+//
+// A session is not safe for concurrent use by multiple goroutines.
+type Session struct {
+	ID     string                      // session ID, empty until committed for new sessions
+	Values map[interface{}]interface{} // session values
+	IsNew  bool                        // session has not been loaded from storage
+
+	// MaxAge is the session lifetime if the manager does not have an idle timeout.
+	// It is initialized from the manager's MaxAge.
+	MaxAge time.Duration
+
+	// ClientIP and UserAgent identify the client that is using the session. They
+	// are not set by the manager, but are saved in the session record when the
+	// session is committed, and are recorded by BindUser.
+	ClientIP  string
+	UserAgent string
+
+	manager       *Manager
+	state         *sessionState
+	cookieValue   string // session cookie value received or last returned
+	readOnly      bool   // storage unavailable, so the session is not saved
+	cookieChanged bool   // cookie value has changed since the session was loaded
+}
+
+// sessionState contains information about a session that is needed by the
+// manager, but is not part of the session values. A session does not have state
+// until it has been loaded from, or saved to, persistent storage.
+type sessionState struct {
+	sid         string      // session ID that this state belongs to
+	saved       bool        // true if the session record exists in storage
+	createdAt   time.Time   // time the session was created
+	expiresAt   time.Time   // time the session record expires
+	lastSeenAt  time.Time   // time the session record was last saved or touched
+	clientIP    string      // client IP address in the session record
+	userAgent   string      // client user agent in the session record
+	fingerprint fingerprint // client fingerprint recorded when the session was created
+	version     int64       // version of the session record, zero if unversioned
+	format      string      // format of data
+	data        []byte      // encoded session values when loaded or last saved
+	cookie      cookieState // session cookie received or last sent
+	noCookie    bool        // loaded via tombstone, so never send a cookie
+	inCookie    bool        // session values are kept in the cookie
+	bound       bool        // session has been bound to a user, recorded in the cookie
+}
+
+// SessionInfo contains metadata about a session.
+type SessionInfo struct {
+	ID         string    // session ID
+	CreatedAt  time.Time // time the session was created
+	LastSeenAt time.Time // approximate time the session was last used
+	ExpiresAt  time.Time // time the session expires if it is not used
+	ClientIP   string    // IP address of the client that last used the session
+	UserAgent  string    // user agent of the client that last used the session
+}
+
+// cookieState contains information about the session cookie that was
+// received with the request, or that was last sent in the response.
+type cookieState struct {
+	sid      string    // session ID encoded in the cookie
+	issuedAt time.Time // time the cookie value was encoded
+	current  bool      // encoded with the current secret keying material
+	values   bool      // cookie contains the session values
+	bound    bool      // cookie records that the session is bound to a user
+	legacy   bool      // cookie does not record whether the session is bound
+
+	fingerprint fingerprint // client fingerprint encoded in the cookie
+}
+
+// CookieChanged reports whether the session cookie value returned by Commit
+// is different from the cookie value that the session was loaded with, in
+// which case it needs to be sent to the client.
+func (s *Session) CookieChanged() bool {
+	return s.cookieChanged
+}
+
+// Degraded reports whether the session is read-only because the storage provider
+// is unavailable. A degraded session is not saved by Commit, and the client's
+// session cookie is left unchanged. See Manager.Degradation.
+func (s *Session) Degraded() bool {
+	return s.readOnly
+}
+
+// Info returns metadata about the session. The last seen time is the time that
+// the session was last committed, or that its expiry time was last extended.
+func (s *Session) Info() *SessionInfo {
+	info := &SessionInfo{
+		ID:        s.ID,
+		ClientIP:  s.ClientIP,
+		UserAgent: s.UserAgent,
+	}
+	if state := s.state; state != nil && state.sid == s.ID {
+		info.CreatedAt = state.createdAt
+		info.LastSeenAt = state.lastSeenAt
+		info.ExpiresAt = state.expiresAt
+		if info.ClientIP == "" {
+			info.ClientIP = state.clientIP
+		}
+		if info.UserAgent == "" {
+			info.UserAgent = state.userAgent
+		}
+	}
+	return info
+}
+
+// Commit persists the session, and returns the session cookie value. If the
+// session does not have an ID, one is assigned.
+//
+// The session record is only written if the session values, client IP address
+// or user agent have changed. The returned cookie value only needs to be sent to
+// the client if CookieChanged reports true.
+func (s *Session) Commit(ctx context.Context) (string, error) {
+	event, err := s.commit(ctx)
+	if err != nil {
+		return "", err
+	}
+	if event != nil {
+		s.manager.emit(ctx, event)
+	}
+	return s.cookieValue, nil
+}
+
+// commit persists the session. It returns the event that describes the change to
+// the session, or nil if the session was not changed.
+func (s *Session) commit(ctx context.Context) (*Event, error) {
+	m := s.manager
+	if s.readOnly {
+		return nil, nil
+	}
+	sid, err := parseSessionID(s.ID)
+	if err != nil {
+		sid, err = newSessionID()
+		if err != nil {
+			// this will only happen if the crypto RNG fails
+			return nil, errors.Wrap(err, "cannot generate random session id")
+		}
+		s.ID = sid.String()
+	}
+
+	now := nowFunc()
+	state := s.state
+	if state == nil || state.sid != s.ID {
+		state = &sessionState{
+			sid:       s.ID,
+			createdAt: now,
+		}
+	}
+	s.state = state
+	if state.fingerprint == (fingerprint{}) {
+		state.fingerprint = m.fingerprint(ctx, s)
+	}
+	var event *Event
+	if !state.saved && !state.inCookie {
+		event = &Event{Type: EventCreated, SessionID: s.ID}
+	} else if m.Events != nil && m.isModified(s, state) {
+		event = &Event{Type: EventSaved, SessionID: s.ID}
+	}
+	if ok, err := m.saveInCookie(ctx, s, state, sid, now); ok || err != nil {
+		if event != nil {
+			event.Reason = "cookie"
+		}
+		return event, err
+	}
+	if !state.saved || state.inCookie || s.clientChanged() || m.isModified(s, state) {
+		rec := storage.Record{
+			CreatedAt:  state.createdAt,
+			ExpiresAt:  m.expiresAt(s, state, now),
+			LastSeenAt: now,
+			ClientIP:   state.clientIP,
+			UserAgent:  state.userAgent,
+		}
+		if s.ClientIP != "" {
+			rec.ClientIP = s.ClientIP
+		}
+		if s.UserAgent != "" {
+			rec.UserAgent = s.UserAgent
+		}
+		if rec.ID, err = m.recordID(ctx, s.ID); err != nil {
+			return nil, err
+		}
+		rec.Format, rec.Data, err = m.encodeValues(s.Values)
+		if err != nil {
+			return nil, err
+		}
+		if err = m.storageAvailable(); err != nil {
+			// do not wait for the storage provider to time out
+		} else if m.OptimisticLocking {
+			err = m.saveVersioned(ctx, s, state, &rec)
+		} else {
+			err = m.DB.Save(ctx, &rec, -1)
+		}
+		if err != nil {
+			if err = m.saveFailed(ctx, s, &rec, err); err != nil || s.readOnly {
+				return nil, err
+			}
+		} else if !state.saved && state.bound {
+			if err := m.checkUnbound(ctx, s, rec.ID); err != nil {
+				return nil, err
+			}
+		}
+		state.saved = true
+		state.inCookie = false
+		state.expiresAt = rec.ExpiresAt
+		state.lastSeenAt = rec.LastSeenAt
+		state.clientIP = rec.ClientIP
+		state.userAgent = rec.UserAgent
+		state.format = rec.Format
+		state.data = rec.Data
+	} else if err := m.touch(ctx, s, state, now); err != nil && !m.storageFailed(ctx, "touch", err) {
+		return nil, err
+	}
+	if !state.noCookie && m.needsCookie(s, state, now) {
+		if err = m.Codec.Refresh(ctx); err != nil {
+			return nil, err
+		}
+		encoded, err := m.encodeCookieID(sid, state)
+		if err != nil {
+			return nil, err
+		}
+		s.setCookie(encoded)
+		state.cookie = cookieState{
+			sid:         s.ID,
+			issuedAt:    now,
+			current:     true,
+			bound:       state.bound,
+			fingerprint: state.fingerprint,
+		}
+	}
+	return event, nil
+}
+
+// Destroy deletes the session from persistent storage, and clears the session ID
+// and values. The client should be sent an empty cookie value.
+func (s *Session) Destroy(ctx context.Context) error {
+	if s.ID != "" {
+		if err := s.manager.deleteSession(ctx, s.ID); err != nil {
+			if err = s.manager.deleteFailed(ctx, s.ID, err); err != nil {
+				return err
+			}
+		}
+		s.manager.emit(ctx, &Event{Type: EventDestroyed, SessionID: s.ID})
+	}
+	s.ID = ""
+	s.Values = make(map[interface{}]interface{})
+	s.state = nil
+	s.setCookie("")
+	return nil
+}
+
+// RegenerateID gives the session a new session ID, while keeping its values.
+// It should be called whenever the privilege level of the session changes,
+// for example when the user logs in or out, to prevent session fixation attacks.
+//
+// The session is committed using the new session ID, and the new session cookie
+// value is returned. The record for the old session ID is then deleted, or
+// replaced with a tombstone record if the manager has a regenerate grace period.
+func (s *Session) RegenerateID(ctx context.Context) (string, error) {
+	m := s.manager
+	now := nowFunc()
+	oldID := s.ID
+	oldState := s.state
+	if oldState != nil && oldState.sid != oldID {
+		oldState = nil
+	}
+	sid, err := newSessionID()
+	if err != nil {
+		// this will only happen if the crypto RNG fails
+		return "", errors.Wrap(err, "cannot generate random session id")
+	}
+	s.ID = sid.String()
+	state := &sessionState{
+		sid:       s.ID,
+		createdAt: now,
+	}
+	if oldState != nil {
+		state.createdAt = oldState.createdAt
+	}
+	s.state = state
+	_, err = s.commit(ctx)
+	if err != nil {
+		// restore the session ID, as the old record has not been changed
+		s.ID = oldID
+		if oldState != nil {
+			s.state = oldState
+		}
+		return "", err
+	}
+
+	cookieValue := s.cookieValue
+	m.emit(ctx, &Event{Type: EventIDRegenerated, SessionID: s.ID, PrevSessionID: oldID})
+	if oldID == "" {
+		return cookieValue, nil
+	}
+	oldRecordID, err := m.recordID(ctx, oldID)
+	if err != nil {
+		return "", err
+	}
+	if m.RegenerateGracePeriod > 0 && oldState != nil && oldState.saved {
+		tombstone := storage.Record{
+			ID:        oldRecordID,
+			Format:    tombstoneFormat,
+			CreatedAt: oldState.createdAt,
+			ExpiresAt: now.Add(m.RegenerateGracePeriod),
+		}
+		if tombstone.Data, err = m.tombstoneData(sid); err != nil {
+			return "", err
+		}
+		if err := m.DB.Save(ctx, &tombstone, -1); err != nil {
+			return "", errors.Wrap(err, "cannot save tombstone for regenerated session")
+		}
+		return cookieValue, nil
+	}
+	if err := m.DB.Delete(ctx, oldRecordID); err != nil {
+		return "", errors.Wrap(err, "cannot delete regenerated session")
+	}
+	return cookieValue, nil
+}
+
+// clientChanged reports whether the client IP address or user agent is different
+// to the one in the session record.
+func (s *Session) clientChanged() bool {
+	return (s.ClientIP != "" && s.ClientIP != s.state.clientIP) ||
+		(s.UserAgent != "" && s.UserAgent != s.state.userAgent)
+}
+
+// setCookie records a new session cookie value.
+func (s *Session) setCookie(value string) {
+	s.cookieValue = value
+	s.cookieChanged = true
+}
@@ -0,0 +1,65 @@
+package session
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestLoadCommit(t *testing.T) {
+	ctx := context.Background()
+	manager := New(memory.New(), "app")
+
+	// empty cookie value returns a new session
+	session := loadSession(t, manager, "")
+	if got, want := session.IsNew, true; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	cookie := saveNewSession(t, manager)
+	session = loadSession(t, manager, cookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// unchanged session returns the same cookie value
+	value, err := session.Commit(ctx)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := value, cookie; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.CookieChanged(), false; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// invalid cookie value returns a new session and an error
+	session, err = manager.Load(ctx, "invalid")
+	if err == nil {
+		t.Errorf("got=nil, want=non-nil")
+	}
+	if session == nil || !session.IsNew {
+		t.Errorf("got=%v, want=new session", session)
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	ctx := context.Background()
+	manager := New(memory.New(), "app")
+	cookie := saveNewSession(t, manager)
+	session := loadSession(t, manager, cookie)
+	if err := session.Destroy(ctx); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := session.ID, ""; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.CookieChanged(), true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := loadSession(t, manager, cookie).IsNew, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build go1.21
+// +build go1.21
+
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+)
+
+// SlogSink is an EventSink that logs each event using a structured logger.
+// Loaded events are logged at debug level, decode failures at warning level,
+// and all other events at info level.
+//
+// Session IDs are bearer credentials, so they are only logged if the manager has
+// HashIDs set, in which case the session_id attribute is the session key. Otherwise
+// the session_fp attribute is logged instead, which is the first 16 hex digits of
+// the SHA-256 hash of the session ID. This identifies the session in the logs,
+// but cannot be used to find the session record or to impersonate the user.
+type SlogSink struct {
+	Logger *slog.Logger // slog.Default() if nil
+}
+
+// SessionEvent implements the EventSink interface.
+func (s *SlogSink) SessionEvent(ctx context.Context, event *Event) {
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	level := slog.LevelInfo
+	switch event.Type {
+	case EventLoaded:
+		level = slog.LevelDebug
+	case EventDecodeFailed:
+		level = slog.LevelWarn
+	}
+	attrs := []slog.Attr{
+		slog.String("event", event.Type.String()),
+		slogSessionID("session", event.SessionID, event.Hashed),
+		slog.String("app_id", event.AppID),
+		slog.String("name", event.Name),
+		slog.Time("time", event.Time),
+	}
+	if event.PrevSessionID != "" {
+		attrs = append(attrs, slogSessionID("prev_session", event.PrevSessionID, event.Hashed))
+	}
+	if event.Reason != "" {
+		attrs = append(attrs, slog.String("reason", event.Reason))
+	}
+	logger.LogAttrs(ctx, level, "session "+event.Type.String(), attrs...)
+}
+
+// slogSessionID returns the attribute that identifies the session with ID sid,
+// which is a session key if hashed is true. Session IDs that are not hashed are
+// replaced with a short fingerprint.
+func slogSessionID(prefix string, sid string, hashed bool) slog.Attr {
+	if hashed || sid == "" {
+		return slog.String(prefix+"_id", sid)
+	}
+	sum := sha256.Sum256([]byte(sid))
+	return slog.String(prefix+"_fp", hex.EncodeToString(sum[:8]))
+}
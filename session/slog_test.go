@@ -0,0 +1,55 @@
+//go:build go1.21
+// +build go1.21
+
+package session
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &SlogSink{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+	sink.SessionEvent(context.Background(), &Event{
+		Type:      EventDestroyed,
+		SessionID: "key",
+		Hashed:    true,
+		AppID:     "app",
+		Reason:    "revoked",
+	})
+	for _, want := range []string{"event=destroyed", "session_id=key", "app_id=app", "reason=revoked"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got=%q, want=%q", buf.String(), want)
+		}
+	}
+
+	// session IDs that are not hashed are not logged
+	buf.Reset()
+	sink.SessionEvent(context.Background(), &Event{
+		Type:          EventIDRegenerated,
+		SessionID:     "sid",
+		PrevSessionID: "prev",
+	})
+	sum := sha256.Sum256([]byte("sid"))
+	if want := "session_fp=" + hex.EncodeToString(sum[:8]); !strings.Contains(buf.String(), want) {
+		t.Errorf("got=%q, want=%q", buf.String(), want)
+	}
+	for _, sid := range []string{"sid", "prev"} {
+		if strings.Contains(buf.String(), "="+sid) {
+			t.Errorf("got=%q, want no %q", buf.String(), sid)
+		}
+	}
+
+	// loaded events are logged at debug level
+	buf.Reset()
+	sink.SessionEvent(context.Background(), &Event{Type: EventLoaded})
+	if got, want := buf.String(), ""; got != want {
+		t.Errorf("got=%q, want=%q", got, want)
+	}
+}
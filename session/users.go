@@ -0,0 +1,541 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/jjeffery/errors"
+	"github.com/jjeffery/sessions/storage"
+)
+
+const (
+	// userEntryFormat is the record format used for the record that binds
+	// a session to a user.
+	userEntryFormat = "user-entry"
+
+	// userIndexFormat is the record format used for the record that lists
+	// the sessions bound to a user, when the storage provider does not
+	// implement the storage.Indexer interface.
+	userIndexFormat = "user-index"
+
+	// userIndexLifetime is the time after which user index records expire.
+	// The expiry time is extended every time the index records are written.
+	userIndexLifetime = 365 * 24 * time.Hour
+
+	// maxIndexAttempts is the number of times that an index record update
+	// is attempted when there are concurrent updates to the same record.
+	maxIndexAttempts = 10
+
+	// pendingBindPeriod is the time after a session is bound to a user during
+	// which the binding is kept even though the session record does not exist,
+	// because the session has not been committed yet.
+	pendingBindPeriod = 5 * time.Minute
+)
+
+// UserSession contains information about a session that is bound to a user.
+type UserSession struct {
+	ID         string    // session ID, or its hash if the manager has HashIDs set
+	CreatedAt  time.Time // time the session was created
+	LastSeenAt time.Time // approximate time the session was last used
+	IP         string    // client IP address when the session was bound
+	UserAgent  string    // client user agent when the session was bound
+}
+
+// userEntry is the persistent form of the binding between a session
+// and a user.
+type userEntry struct {
+	UserID    string
+	SessionID string // session key, see Manager.sessionKey
+	CreatedAt time.Time
+	BoundAt   time.Time
+	IP        string
+	UserAgent string
+}
+
+// BindUser binds the session to the user identified by userID, so that the session
+// is included in the results of ListUserSessions and RevokeUserSessions. A session
+// can only be bound to one user: binding it again replaces the previous binding.
+//
+// If the session does not have an ID, one is assigned. The session still needs
+// to be committed in the usual way. A session that is bound to a user is always
+// saved in a session record, even if the manager has a cookie values threshold.
+//
+// The user binding is for the session ID, so if RegenerateID is called after
+// BindUser, then BindUser needs to be called again for the new session ID. The
+// usual sequence when a user logs in is to call RegenerateID and then BindUser.
+//
+// The session's ClientIP and UserAgent are recorded with the binding, and are
+// reported by ListUserSessions.
+//
+// If the manager has MaxUserSessions set, binding the session may revoke one of
+// the user's other sessions, or fail with a *SessionLimitError, depending on the
+// manager's SessionLimitPolicy. A session that is bound before it is committed
+// counts towards the limit, and if it is revoked before it is committed, Commit
+// deletes it and returns an error.
+//
+// If the storage provider implements the storage.Indexer interface, then each
+// binding is a separate record that is indexed by the storage provider. Otherwise
+// each user has a versioned index record that lists the user's session IDs.
+func (s *Session) BindUser(ctx context.Context, userID string) error {
+	m := s.manager
+	errors := errors.With("user", userID)
+	if userID == "" {
+		return errors.New("empty user id")
+	}
+	if _, err := parseSessionID(s.ID); err != nil {
+		sid, err := newSessionID()
+		if err != nil {
+			// this will only happen if the crypto RNG fails
+			return errors.Wrap(err, "cannot generate random session id")
+		}
+		s.ID = sid.String()
+	}
+	key, err := m.sessionKey(ctx, s.ID)
+	if err != nil {
+		return err
+	}
+	now := nowFunc()
+	entry := userEntry{
+		UserID:    userID,
+		SessionID: key,
+		CreatedAt: now,
+		BoundAt:   now,
+		IP:        s.ClientIP,
+		UserAgent: s.UserAgent,
+	}
+	state := s.state
+	if state == nil || state.sid != s.ID {
+		state = &sessionState{
+			sid:       s.ID,
+			createdAt: now,
+		}
+		s.state = state
+	}
+	entry.CreatedAt = state.createdAt
+	if m.MaxUserSessions > 0 {
+		if err := m.limitUserSessions(ctx, userID, key); err != nil {
+			return err
+		}
+	}
+	state.bound = true
+	data, err := encodeGob(&entry)
+	if err != nil {
+		return err
+	}
+	rec := storage.Record{
+		ID:        m.userEntryID(key),
+		Format:    userEntryFormat,
+		Data:      data,
+		CreatedAt: now,
+		ExpiresAt: now.Add(userIndexLifetime),
+	}
+	if _, ok := m.DB.(storage.Indexer); ok {
+		rec.IndexKey = m.userIndexID(userID)
+	}
+	if err := m.DB.Save(ctx, &rec, -1); err != nil {
+		return errors.Wrap(err, "cannot save user binding")
+	}
+	if _, ok := m.DB.(storage.Indexer); ok || m.MaxUserSessions > 0 {
+		// the index has already been updated if there is a session limit
+		return nil
+	}
+	err = m.updateUserIndex(ctx, userID, func(sids []string) ([]string, error) {
+		for _, sid := range sids {
+			if sid == key {
+				return sids, nil
+			}
+		}
+		return append(sids, key), nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot update user index")
+	}
+	return nil
+}
+
+// ListUserSessions returns information about the sessions that are bound to the
+// user identified by userID, ordered by creation time. Sessions that have expired
+// or been deleted are not included, and their user bindings are removed.
+//
+// The last seen time is derived from the expiry time of the session record,
+// and is only accurate to within the manager's TouchInterval.
+func (m *Manager) ListUserSessions(ctx context.Context, userID string) ([]*UserSession, error) {
+	entries, err := m.userEntries(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := nowFunc()
+	var list []*UserSession
+	stale := make(map[string]bool)
+	for _, entry := range entries {
+		us, err := m.userSession(ctx, entry, now)
+		if err != nil {
+			return nil, err
+		}
+		if us == nil {
+			stale[entry.SessionID] = true
+			continue
+		}
+		list = append(list, us)
+	}
+	if err := m.pruneUserSessions(ctx, userID, stale, now); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// RevokeUserSessions deletes all of the sessions that are bound to the user
+// identified by userID. This is useful for logging a user out of every device,
+// for example after the user's password has been reset.
+func (m *Manager) RevokeUserSessions(ctx context.Context, userID string) error {
+	entries, err := m.userEntries(ctx, userID)
+	if err != nil {
+		return err
+	}
+	revoked := make(map[string]bool)
+	for _, entry := range entries {
+		revoked[entry.SessionID] = true
+	}
+	// The user bindings are deleted first, so that a session that has not
+	// been committed yet is deleted by Commit when it finds no binding.
+	if err := m.unbindUser(ctx, userID, revoked); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := m.DB.Delete(ctx, m.keyRecordID(entry.SessionID)); err != nil {
+			return errors.Wrap(err, "cannot delete session").With("user", userID)
+		}
+		m.send(ctx, &Event{Type: EventDestroyed, SessionID: entry.SessionID, Reason: "revoked"})
+	}
+	return nil
+}
+
+// userSession returns information about the session bound to a user by entry,
+// or nil if the session has expired or been deleted. A session without a record
+// that was bound recently is reported, as it may not have been committed yet.
+func (m *Manager) userSession(ctx context.Context, entry *userEntry, now time.Time) (*UserSession, error) {
+	rec, err := m.DB.Fetch(ctx, m.keyRecordID(entry.SessionID))
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return pendingUserSession(entry, now), nil
+	}
+	if rec.Format == tombstoneFormat || !rec.ExpiresAt.After(now) {
+		return nil, nil
+	}
+	us := &UserSession{
+		ID:         entry.SessionID,
+		CreatedAt:  entry.CreatedAt,
+		LastSeenAt: m.lastSeenAt(rec, entry),
+		IP:         entry.IP,
+		UserAgent:  entry.UserAgent,
+	}
+	if !rec.CreatedAt.IsZero() {
+		us.CreatedAt = rec.CreatedAt
+	}
+	return us, nil
+}
+
+// pendingUserSession returns information about the session bound to a user by
+// entry if it was bound recently, and so may not have been committed yet. The
+// session is reported as created and last seen when it was bound.
+func pendingUserSession(entry *userEntry, now time.Time) *UserSession {
+	if entry.BoundAt.IsZero() || now.Sub(entry.BoundAt) >= pendingBindPeriod {
+		return nil
+	}
+	return &UserSession{
+		ID:         entry.SessionID,
+		CreatedAt:  entry.CreatedAt,
+		LastSeenAt: entry.BoundAt,
+		IP:         entry.IP,
+		UserAgent:  entry.UserAgent,
+	}
+}
+
+// checkUnbound is called after a session that was bound to a user is saved for
+// the first time. If the user binding has been removed in the meantime, because
+// the session was evicted or revoked before it was committed, the session record
+// is deleted so that the session does not outlive its binding.
+func (m *Manager) checkUnbound(ctx context.Context, session *Session, recordID string) error {
+	bound, err := m.isBound(ctx, session.ID)
+	if err != nil || bound {
+		return err
+	}
+	if err := m.DB.Delete(ctx, recordID); err != nil {
+		return errors.Wrap(err, "cannot delete revoked session")
+	}
+	session.state = nil
+	return errors.New("session revoked before it was committed")
+}
+
+// isBound reports whether the session with ID sid is bound to a user.
+func (m *Manager) isBound(ctx context.Context, sid string) (bool, error) {
+	key, err := m.sessionKey(ctx, sid)
+	if err != nil {
+		return false, err
+	}
+	rec, err := m.DB.Fetch(ctx, m.userEntryID(key))
+	if err != nil {
+		return false, errors.Wrap(err, "cannot fetch user binding")
+	}
+	return rec != nil, nil
+}
+
+// userEntries returns the user bindings for userID. Bindings that have
+// been replaced by a binding to another user are not included.
+func (m *Manager) userEntries(ctx context.Context, userID string) ([]*userEntry, error) {
+	errors := errors.With("user", userID)
+	var entries []*userEntry
+	if indexer, ok := m.DB.(storage.Indexer); ok {
+		iter := indexer.ListIndexed(ctx, m.userIndexID(userID), 0)
+		for iter.Next() {
+			entry, err := decodeUserEntry(iter.Record())
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot decode user binding")
+			}
+			if entry.UserID == userID {
+				entries = append(entries, entry)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, errors.Wrap(err, "cannot list user bindings")
+		}
+		return entries, nil
+	}
+
+	index, err := m.DB.Fetch(ctx, m.userIndexID(userID))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch user index")
+	}
+	sids, err := decodeUserIndex(index)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode user index")
+	}
+	for _, sid := range sids {
+		rec, err := m.DB.Fetch(ctx, m.userEntryID(sid))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot fetch user binding")
+		}
+		if rec == nil {
+			// binding has expired: include an entry so that
+			// it is removed from the index
+			entries = append(entries, &userEntry{UserID: userID, SessionID: sid})
+			continue
+		}
+		entry, err := decodeUserEntry(rec)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode user binding")
+		}
+		if entry.UserID == userID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// pruneUserSessions removes the bindings between the user and the session IDs in
+// stale, which were found to be expired or deleted. Each binding is checked again
+// before it is removed, because the session may have been bound again, or
+// committed, since it was found to be stale. A binding is only removed if its
+// session record has expired or been replaced with a tombstone, or if it has
+// no session record and was bound longer ago than pendingBindPeriod.
+func (m *Manager) pruneUserSessions(ctx context.Context, userID string, stale map[string]bool, now time.Time) error {
+	for sid := range stale {
+		rec, err := m.DB.Fetch(ctx, m.userEntryID(sid))
+		if err != nil {
+			return errors.Wrap(err, "cannot fetch user binding").With("user", userID)
+		}
+		if rec == nil {
+			continue
+		}
+		entry, err := decodeUserEntry(rec)
+		if err != nil {
+			return errors.Wrap(err, "cannot decode user binding").With("user", userID)
+		}
+		if entry.UserID != userID {
+			continue
+		}
+		us, err := m.userSession(ctx, entry, now)
+		if err != nil {
+			return err
+		}
+		if us != nil {
+			delete(stale, sid)
+		}
+	}
+	return m.unbindUser(ctx, userID, stale)
+}
+
+// unbindUser removes the bindings between the user and the session IDs in sids.
+func (m *Manager) unbindUser(ctx context.Context, userID string, sids map[string]bool) error {
+	if len(sids) == 0 {
+		return nil
+	}
+	errors := errors.With("user", userID)
+	for sid := range sids {
+		rec, err := m.DB.Fetch(ctx, m.userEntryID(sid))
+		if err != nil {
+			return errors.Wrap(err, "cannot fetch user binding")
+		}
+		if rec != nil {
+			entry, err := decodeUserEntry(rec)
+			if err != nil {
+				return errors.Wrap(err, "cannot decode user binding")
+			}
+			if entry.UserID != userID {
+				// session has been bound to another user in the meantime
+				continue
+			}
+			if err := m.DB.Delete(ctx, rec.ID); err != nil {
+				return errors.Wrap(err, "cannot delete user binding")
+			}
+		}
+	}
+	if _, ok := m.DB.(storage.Indexer); ok {
+		return nil
+	}
+	err := m.updateUserIndex(ctx, userID, func(old []string) ([]string, error) {
+		var sidList []string
+		for _, sid := range old {
+			if !sids[sid] {
+				sidList = append(sidList, sid)
+			}
+		}
+		return sidList, nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot update user index")
+	}
+	return nil
+}
+
+// updateUserIndex updates the versioned index record for userID, which contains
+// the IDs of the sessions bound to the user. If the record is modified by another
+// request during the update, the update is retried.
+func (m *Manager) updateUserIndex(ctx context.Context, userID string, update func(sids []string) ([]string, error)) error {
+	id := m.userIndexID(userID)
+	for attempt := 1; ; attempt++ {
+		index, err := m.DB.Fetch(ctx, id)
+		if err != nil {
+			return err
+		}
+		sids, err := decodeUserIndex(index)
+		if err != nil {
+			return err
+		}
+		var oldVersion int64
+		if index != nil {
+			oldVersion = index.Version
+		}
+		if sids, err = update(sids); err != nil {
+			return err
+		}
+		if len(sids) == 0 {
+			if index == nil {
+				return nil
+			}
+			// An empty index is deleted. There is a small chance that this
+			// deletes a session ID added by a concurrent request, in which
+			// case the binding will be restored when BindUser is next called
+			// for that session.
+			return m.DB.Delete(ctx, id)
+		}
+		now := nowFunc()
+		rec := storage.Record{
+			ID:        id,
+			Version:   oldVersion + 1,
+			Format:    userIndexFormat,
+			CreatedAt: now,
+			ExpiresAt: now.Add(userIndexLifetime),
+		}
+		if index != nil && !index.CreatedAt.IsZero() {
+			rec.CreatedAt = index.CreatedAt
+		}
+		if rec.Data, err = encodeGob(sids); err != nil {
+			return err
+		}
+		err = m.DB.Save(ctx, &rec, oldVersion)
+		if err == nil {
+			return nil
+		}
+		if err != storage.ErrVersionConflict || attempt >= maxIndexAttempts {
+			return err
+		}
+	}
+}
+
+// lastSeenAt returns the approximate time that the session was last used. Records
+// saved before last seen times were recorded use the expiry time of the record.
+func (m *Manager) lastSeenAt(rec *storage.Record, entry *userEntry) time.Time {
+	if !rec.LastSeenAt.IsZero() {
+		return rec.LastSeenAt
+	}
+	expiresIn := m.IdleTimeout
+	if expiresIn <= 0 {
+		expiresIn = m.MaxAge
+		if expiresIn <= 0 {
+			expiresIn = time.Hour * 24
+		}
+	}
+	lastSeenAt := rec.ExpiresAt.Add(-expiresIn)
+	if lastSeenAt.Before(entry.BoundAt) {
+		// expiry time has been limited by the absolute timeout
+		lastSeenAt = entry.BoundAt
+	}
+	return lastSeenAt
+}
+
+// userIndexID returns the record ID of the index for userID. The index
+// is either a versioned index record, or the index key of the user binding
+// records if the storage provider implements storage.Indexer.
+func (m *Manager) userIndexID(userID string) string {
+	return m.keyRecordID("user-" + userID)
+}
+
+// userEntryID returns the record ID of the user binding for the session
+// with the specified session key.
+func (m *Manager) userEntryID(key string) string {
+	return m.keyRecordID(key) + "-user"
+}
+
+func decodeUserEntry(rec *storage.Record) (*userEntry, error) {
+	if rec.Format != userEntryFormat {
+		return nil, errors.New("unexpected user binding format").With("format", rec.Format)
+	}
+	var entry userEntry
+	if err := gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// decodeUserIndex returns the session IDs in the user index record.
+// It returns an empty list if rec is nil.
+func decodeUserIndex(rec *storage.Record) ([]string, error) {
+	if rec == nil {
+		return nil, nil
+	}
+	if rec.Format != userIndexFormat {
+		return nil, errors.New("unexpected user index format").With("format", rec.Format)
+	}
+	var sids []string
+	if err := gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&sids); err != nil {
+		return nil, err
+	}
+	return sids, nil
+}
+
+func encodeGob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,234 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+// plainProvider hides the optional interfaces implemented by the
+// underlying storage provider.
+type plainProvider struct {
+	storage.Provider
+}
+
+func TestUserSessions(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		db      storage.Provider
+		hashIDs bool
+	}{
+		{name: "indexer", db: memory.New()},
+		{name: "versioned", db: plainProvider{memory.New()}},
+		{name: "hashed", db: memory.New(), hashIDs: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := New(tt.db, "app")
+			manager.HashIDs = tt.hashIDs
+			testUserSessions(t, manager)
+		})
+	}
+}
+
+func testUserSessions(t *testing.T, manager *Manager) {
+	ctx := context.Background()
+	var sids []string
+	for _, userAgent := range []string{"phone", "laptop", "tablet"} {
+		session, err := manager.Load(ctx, "")
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		session.ClientIP = "192.0.2.1"
+		session.UserAgent = userAgent
+		session.Values["key"] = "value"
+		if err := session.BindUser(ctx, "alice"); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if _, err := session.Commit(ctx); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		sids = append(sids, session.ID)
+	}
+
+	// a session bound to another user
+	{
+		session, _ := manager.Load(ctx, "")
+		if err := session.BindUser(ctx, "bob"); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		if _, err := session.Commit(ctx); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+	}
+
+	list, err := manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 3; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	ids := make(map[string]*UserSession)
+	for _, us := range list {
+		ids[us.ID] = us
+		if got, want := us.IP, "192.0.2.1"; got != want {
+			t.Errorf("got=%v, want=%v", got, want)
+		}
+		if us.CreatedAt.IsZero() || us.LastSeenAt.IsZero() {
+			t.Errorf("got zero time, want non-zero")
+		}
+	}
+	for _, sid := range sids {
+		if ids[testSessionKey(t, manager, sid)] == nil {
+			t.Errorf("missing session %s", sid)
+		}
+	}
+
+	// deleted sessions are not listed, once they are too old to be pending
+	if err := manager.DB.Delete(ctx, testRecordID(t, manager, sids[0])); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	defer restoreStubs()
+	fakeNow := time.Now().Add(pendingBindPeriod)
+	nowFunc = func() time.Time {
+		return fakeNow
+	}
+	list, err = manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 2; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// rebinding to another user removes the session from the first user
+	{
+		session, _ := manager.Load(ctx, "")
+		session.ID = sids[1]
+		if err := session.BindUser(ctx, "bob"); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+	}
+	list, err = manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := list[0].ID, testSessionKey(t, manager, sids[2]); got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// revoke all of bob's sessions
+	if err := manager.RevokeUserSessions(ctx, "bob"); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	list, err = manager.ListUserSessions(ctx, "bob")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 0; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	rec, err := manager.DB.Fetch(ctx, testRecordID(t, manager, sids[1]))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if rec != nil {
+		t.Errorf("got=%v, want=nil", rec)
+	}
+
+	// alice's remaining session is unaffected
+	list, err = manager.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestUserSessionsBeforeCommit(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		db   storage.Provider
+	}{
+		{name: "indexer", db: memory.New()},
+		{name: "versioned", db: plainProvider{memory.New()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer restoreStubs()
+			ctx := context.Background()
+			fakeNow := time.Now()
+			nowFunc = func() time.Time {
+				return fakeNow
+			}
+			manager := New(tt.db, "app")
+			session := manager.NewSession()
+			session.Values["key"] = "value"
+			if err := session.BindUser(ctx, "alice"); err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+
+			// listing between bind and commit does not remove the binding
+			for i := 0; i < 2; i++ {
+				list, err := manager.ListUserSessions(ctx, "alice")
+				if err != nil {
+					t.Fatalf("got=%v, want=nil", err)
+				}
+				if got, want := len(list), 1; got != want {
+					t.Fatalf("%d: got=%v, want=%v", i, got, want)
+				}
+			}
+			if _, err := session.Commit(ctx); err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			fakeNow = fakeNow.Add(pendingBindPeriod)
+			list, err := manager.ListUserSessions(ctx, "alice")
+			if err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			if got, want := len(list), 1; got != want {
+				t.Fatalf("got=%v, want=%v", got, want)
+			}
+			if got, want := list[0].ID, testSessionKey(t, manager, session.ID); got != want {
+				t.Errorf("got=%v, want=%v", got, want)
+			}
+
+			// a binding without a session record is removed after the grace period
+			other := manager.NewSession()
+			if err := other.BindUser(ctx, "alice"); err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			fakeNow = fakeNow.Add(pendingBindPeriod)
+			if list, err = manager.ListUserSessions(ctx, "alice"); err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			if got, want := len(list), 1; got != want {
+				t.Fatalf("got=%v, want=%v", got, want)
+			}
+			rec, err := manager.DB.Fetch(ctx, manager.userEntryID(testSessionKey(t, manager, other.ID)))
+			if err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			if rec != nil {
+				t.Errorf("got=%v, want=nil", rec.ID)
+			}
+		})
+	}
+}
+
+// testSessionKey returns the session key for the session ID sid, which is
+// the ID reported by ListUserSessions.
+func testSessionKey(t *testing.T, manager *Manager, sid string) string {
+	t.Helper()
+	key, err := manager.sessionKey(context.Background(), sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
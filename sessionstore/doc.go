@@ -1,7 +1,14 @@
 // Package sessionstore provides a session store for persistence of HTTP session data.
 // The session store is compatible with Gorilla sessions (github.com/gorilla/sessions).
 //
+// The session store is an adapter over the session manager in package session, which
+// can be used directly by programs that do not use Gorilla sessions or net/http.
+//
 // The session store also persists randomly generated secret keying material that
 // is used for generating the keys used to sign and encrypt the secure session
 // cookies. The secret keying material is regularly rotated.
+//
+// Sessions can be used with the Gorilla sessions API, or via Middleware, which
+// loads the session into the request context and saves it automatically. Handlers
+// obtain the session by calling FromContext.
 package sessionstore
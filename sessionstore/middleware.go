@@ -0,0 +1,178 @@
+package sessionstore
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/errors"
+)
+
+// contextKey is the key for the session loader in the request context.
+type contextKey struct{}
+
+// Middleware is net/http middleware that makes a session available to HTTP
+// handlers via the request context, and saves the session automatically.
+//
+// The session is loaded lazily, the first time that FromContext is called for
+// the request. If the session has been loaded, it is saved just before the
+// response headers are written, so that the session cookie can be included
+// in the response. As the store only writes sessions that have been modified,
+// there is little cost in saving a session that has not changed.
+//
+// Middleware does not use the Gorilla sessions registry, so it does not depend
+// on any request-scoped state other than the request context.
+type Middleware struct {
+	Store *Store
+	Name  string // session name, which is also the cookie name
+
+	// ErrorHandler is called if the session cannot be saved. The handler can
+	// write a response, in which case any response written by the next handler
+	// is discarded. If nil, an HTTP 500 response is written.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Handler returns an HTTP handler that calls next with a request context that
+// contains the session, and saves the session before the response headers are
+// written.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loader := &sessionLoader{
+			store: m.Store,
+			name:  m.Name,
+		}
+		// the session state registry is added to the context here, so that it
+		// is shared by the requests passed to the store's New and Save methods
+		ctx := context.WithValue(r.Context(), contextKey{}, loader)
+		ctx = context.WithValue(ctx, registryKey{}, newRegistry())
+		r = r.WithContext(ctx)
+		loader.r = r
+		rw := &responseWriter{
+			ResponseWriter: w,
+			r:              r,
+			loader:         loader,
+			onError:        m.ErrorHandler,
+		}
+		next.ServeHTTP(rw, r)
+		// save the session if the handler did not write a response
+		rw.saveSession()
+	})
+}
+
+// FromContext returns the session from the context, loading it if necessary.
+// The context must be a request context created by Middleware. As with the
+// store's New method, a non-nil session is returned even if there is an error
+// loading the session.
+func FromContext(ctx context.Context) (*sessions.Session, error) {
+	loader, ok := ctx.Value(contextKey{}).(*sessionLoader)
+	if !ok {
+		return nil, errors.New("no session middleware for context")
+	}
+	return loader.load()
+}
+
+// sessionLoader loads the session for a request when it is first needed.
+type sessionLoader struct {
+	store *Store
+	name  string
+	r     *http.Request
+
+	mutex   sync.Mutex
+	session *sessions.Session
+	err     error
+}
+
+func (sl *sessionLoader) load() (*sessions.Session, error) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	if sl.session == nil {
+		sl.session, sl.err = sl.store.New(sl.r, sl.name)
+	}
+	return sl.session, sl.err
+}
+
+// loaded returns the session if it has been loaded, or nil otherwise.
+func (sl *sessionLoader) loaded() *sessions.Session {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	return sl.session
+}
+
+// responseWriter saves the session before the response headers are written.
+type responseWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	loader  *sessionLoader
+	onError func(w http.ResponseWriter, r *http.Request, err error)
+
+	saved   bool // session has been saved, or did not need saving
+	discard bool // error response written, so discard the handler response
+}
+
+// saveSession saves the session, if it has been loaded and has not been saved
+// already. It returns false if the session could not be saved, and an error
+// response has been written instead.
+func (rw *responseWriter) saveSession() bool {
+	if rw.saved {
+		return !rw.discard
+	}
+	rw.saved = true
+	session := rw.loader.loaded()
+	if session == nil {
+		return true
+	}
+	if err := rw.loader.store.Save(rw.r, rw.ResponseWriter, session); err != nil {
+		rw.discard = true
+		if rw.onError != nil {
+			rw.onError(rw.ResponseWriter, rw.r, err)
+		} else {
+			http.Error(rw.ResponseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return false
+	}
+	return true
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.saveSession() {
+		rw.ResponseWriter.WriteHeader(statusCode)
+	}
+}
+
+// Write implements the http.ResponseWriter interface.
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.saveSession() {
+		// pretend to succeed, so that the handler does not report an error
+		return len(p), nil
+	}
+	return rw.ResponseWriter.Write(p)
+}
+
+// Flush implements the http.Flusher interface.
+func (rw *responseWriter) Flush() {
+	if !rw.saveSession() {
+		return
+	}
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface. The session is not saved.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	rw.saved = true
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying response writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
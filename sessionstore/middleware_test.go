@@ -0,0 +1,119 @@
+package sessionstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestMiddleware(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "app")
+	mw := &Middleware{Store: store, Name: testSessionName}
+
+	var loads int
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/none" {
+			// session is not loaded
+			io.WriteString(w, "none")
+			return
+		}
+		session, err := FromContext(r.Context())
+		if err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		loads++
+		count, _ := session.Values["count"].(int)
+		session.Values["count"] = count + 1
+		if r.URL.Path == "/empty" {
+			// no response written by handler
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "ok")
+	}))
+
+	serve := func(path string, cookie *http.Cookie) *http.Response {
+		t.Helper()
+		r := httptest.NewRequest("GET", path, nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	resp := serve("/", nil)
+	if got, want := resp.StatusCode, http.StatusCreated; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	cookies := resp.Cookies()
+	if got, want := len(cookies), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	cookie := cookies[0]
+
+	// session is saved even if the handler writes nothing
+	resp = serve("/empty", cookie)
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// session is not loaded unless needed
+	resp = serve("/none", cookie)
+	if got, want := len(resp.Cookies()), 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	session := loadSession(t, store, cookie)
+	if got, want := session.Values["count"], 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := loads, 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+// failingProvider fails to save any records.
+type failingProvider struct {
+	storage.Provider
+}
+
+func (db failingProvider) Save(ctx context.Context, rec *storage.Record, oldVersion int64) error {
+	return errors.New("save failed")
+}
+
+func TestMiddlewareSaveError(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "app")
+	store.Codec.Refresh(context.Background())
+	store.DB = failingProvider{store.DB}
+
+	var handlerErr error
+	mw := &Middleware{Store: store, Name: testSessionName}
+	handler := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := FromContext(r.Context())
+		session.Values["key"] = "value"
+		_, handlerErr = io.WriteString(w, "ok")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got, want := w.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if handlerErr != nil {
+		t.Errorf("got=%v, want=nil", handlerErr)
+	}
+
+	// no middleware
+	if _, err := FromContext(context.Background()); err == nil {
+		t.Errorf("got=nil, want=non-nil")
+	}
+}
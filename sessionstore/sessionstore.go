@@ -1,70 +1,89 @@
 package sessionstore
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/gob"
-	"encoding/hex"
-	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/jjeffery/errors"
 	"github.com/jjeffery/sessions/codec"
+	"github.com/jjeffery/sessions/rememberme"
+	"github.com/jjeffery/sessions/session"
 	"github.com/jjeffery/sessions/storage"
 )
 
-var (
-	nowFunc           = time.Now
-	randRead          = rand.Read
-	errEmptySessionID = errors.New("empty session id")
+// Types defined in package session, which are used by the Store. They are
+// aliased here so that programs using the Store do not need to import
+// package session.
+type (
+	SessionSerializer     = session.Serializer
+	ValueSerializer       = session.ValueSerializer
+	GobSerializer         = session.GobSerializer
+	JSONSerializer        = session.JSONSerializer
+	MessagePackSerializer = session.MessagePackSerializer
+	MergeFunc             = session.MergeFunc
+	ConflictError         = session.ConflictError
+	UserSession           = session.UserSession
+	SessionInfo           = session.SessionInfo
+	EventSink             = session.EventSink
+	Event                 = session.Event
+	EventType             = session.EventType
+	MemorySink            = session.MemorySink
+	FingerprintFunc       = session.FingerprintFunc
+	FingerprintPolicy     = session.FingerprintPolicy
+	FingerprintError      = session.FingerprintError
+	SessionLimitPolicy    = session.SessionLimitPolicy
+	SessionLimitError     = session.SessionLimitError
+	DegradationPolicy     = session.DegradationPolicy
+	Degradation           = session.Degradation
 )
 
-type sessionID [16]byte
-
-func newSessionID() (sessionID, error) {
-	var sid sessionID
-	if _, err := randRead(sid[:]); err != nil {
-		return sid, err
-	}
-	return sid, nil
-}
-
-func (sid sessionID) String() string {
-	str := hex.EncodeToString(sid[:])
-	return str
-}
-
-func parseSessionID(str string) (sessionID, error) {
-	var sid sessionID
-	if str == "" {
-		// empty session IDs are expected, so detect and error quickly
-		return sid, errEmptySessionID
-	}
-	n, err := hex.Decode(sid[:], []byte(str))
-	if err != nil {
-		return sid, err
-	}
-	if n < len(sid) {
-		return sid, fmt.Errorf("sessionID too small len=%d", n)
-	}
-	return sid, nil
-}
-
 // Store implements the Gorilla Sessions sessions.Store interface for persistence
 // of HTTP session data.
 //
+// The Store is an adapter over a session.Manager, which does the work of loading
+// and saving sessions. The fields of the embedded Manager control session expiry,
+// optimistic locking, ID regeneration, serialization and the other features
+// described in the session.Manager documentation. The Manager's Name field is not
+// used: the cookie name is the session name passed to Get and New.
+//
 // The Store automatically generates and persists random secret keying material
 // that is used for generating the keys used to sign and encrypt the secure session
 // cookies. The secret keying material is regularly rotated.
 //
+// If RememberMe is set, then when a request does not have a current session, but
+// it does have a remember-me cookie, a new session is established for the
+// remembered user. The session is bound to the user, and the user ID is saved
+// in the session values using the remember-me manager's UserIDKey. The
+// remember-me cookie is replaced when the session is saved. Use Remember to
+// issue a remember-me cookie when the user logs in, and Forget when the user
+// logs out.
+//
+// Set the embedded Manager's Events field to receive an Event for each session
+// lifecycle change, such as the session being created, regenerated or destroyed.
+//
+// Set the embedded Manager's Degradation field to keep serving requests when the
+// storage provider is unavailable. Use Degraded to check whether a session is
+// read-only because of a storage outage.
+//
+// The session value is sent in the session cookie, unless Transport is set. API
+// clients that do not use cookies can use BearerTransport or HeaderTransport to
+// send the same encoded session value in a request header.
+//
+// When a session is saved, the session cookie is only sent if the Manager has
+// re-encoded the cookie value, or if the session's cookie options have changed.
+//
+// New is the only supported way to create a Store. The DB, AppID and Codec fields
+// that earlier versions of Store declared directly are now promoted from the
+// embedded Manager, so composite literals such as Store{DB: db, Codec: c} no
+// longer compile. Call New, and then set any other fields on the returned store.
+//
 // While all fields are public, they should not be modified once the store is in use.
 type Store struct {
-	DB      storage.Provider
-	Options sessions.Options
-	AppID   string // set if multiple apps share the same storage provider
-	Codec   *codec.Codec
+	session.Manager
+	Options    sessions.Options
+	RememberMe *rememberme.Manager // re-establishes expired sessions if not nil
+	Transport  Transport           // carries the session value, CookieTransport if nil
 }
 
 // New creates a new store suitable for persisting sessions. Session
@@ -75,17 +94,20 @@ type Store struct {
 // rotate their own, independent secret keying material.
 func New(db storage.Provider, options sessions.Options, appid string) *Store {
 	return &Store{
-		DB:      db,
-		Options: options,
-		AppID:   appid,
-		Codec: &codec.Codec{
-			DB: db,
-			// This could be zero: set this directly if you want to
-			// specify a max age for cookies, but want to leave max-age=0
-			// in the cookie.
-			MaxAge:   time.Duration(options.MaxAge) * time.Second,
-			SecretID: appid + "_secrets",
+		Manager: session.Manager{
+			DB:     db,
+			AppID:  appid,
+			MaxAge: time.Duration(options.MaxAge) * time.Second,
+			Codec: &codec.Codec{
+				DB: db,
+				// This could be zero: set this directly if you want to
+				// specify a max age for cookies, but want to leave max-age=0
+				// in the cookie.
+				MaxAge:   time.Duration(options.MaxAge) * time.Second,
+				SecretID: appid + "_secrets",
+			},
 		},
+		Options: options,
 	}
 }
 
@@ -98,108 +120,235 @@ func (ss *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
 //
 // Note that New should never return a nil session, even in the case of
 // an error if using the Registry infrastructure to cache the session.
+//
+// If the Manager has a Fingerprint function, the fingerprint of the client is
+// checked using the request's RemoteAddr and User-Agent header. If the fingerprint
+// does not match, and the fingerprint policy is session.FingerprintFlag, then
+// the session is returned with a *FingerprintError.
 func (ss *Store) New(r *http.Request, name string) (*sessions.Session, error) {
-	session := sessions.NewSession(ss, name)
+	gs := sessions.NewSession(ss, name)
 	// make a copy
 	options := ss.Options
-	session.Options = &options
-	session.IsNew = true
-	c, err := r.Cookie(name)
-	if err == http.ErrNoCookie {
-		return session, nil
+	gs.Options = &options
+	gs.IsNew = true
+	cookieValue := ss.transport().Get(r, name)
+	ctx := session.WithClient(r.Context(), remoteIP(r), r.UserAgent())
+	s, err := ss.manager(name).Load(ctx, cookieValue)
+	s.MaxAge = time.Duration(options.MaxAge) * time.Second
+	state := &sessionState{
+		session:     s,
+		cookieValue: cookieValue,
+		options:     options,
 	}
-	if err != nil {
-		// this will not get exercised, as ErrNoCookie is the
-		// only error returned by the http.Request.Cookie method
-		err = errors.Wrap(err, "cannot obtain cookie")
-		return session, err
+	if err == nil && s.IsNew && !s.Degraded() && ss.RememberMe != nil {
+		err = ss.remember(r, state)
 	}
-	if err := ss.Codec.Refresh(r.Context()); err != nil {
-		err = errors.Wrap(err, "cannot refresh codec")
-		return session, err
-	}
-	var sid sessionID
-	err = ss.Codec.Decode(name, c.Value, &sid)
-	if err != nil {
-		err = errors.Wrap(err, "cannot decode cookie")
-		return session, err
-	}
-	session.ID = sid.String()
-	rec, err := ss.DB.Fetch(r.Context(), ss.recordID(session))
-	if err == nil && rec != nil {
-		session.IsNew = false //  session data exists, so not new
-		if rec.Data != nil {
-			decoder := gob.NewDecoder(bytes.NewReader(rec.Data))
-			if err := decoder.Decode(&session.Values); err != nil {
-				return session, err
-			}
-		}
-	}
-	return session, err
+	copyFromSession(r, gs, state)
+	return gs, err
 }
 
 // Save persists session to the underlying store implementation.
-func (ss *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
-	// Marked for deletion.
-	if session.Options.MaxAge < 0 {
-		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
-		if session.ID != "" {
-			if err := ss.DB.Delete(r.Context(), ss.recordID(session)); err != nil {
-				return err
-			}
-		}
-	} else {
-		sid, err := parseSessionID(session.ID)
-		if err != nil {
-			sid, err = newSessionID()
-			if err != nil {
-				// this will only happen if the crypto RNG fails
-				return errors.Wrap(err, "cannot generate random session id")
-			}
-			session.ID = sid.String()
-		}
-
-		expiresIn := time.Duration(session.Options.MaxAge) * time.Second
-		if expiresIn <= 0 {
-			expiresIn = time.Hour * 24
-		}
-		rec := storage.Record{
-			ID:        ss.recordID(session),
-			Format:    "gob",
-			ExpiresAt: nowFunc().Add(expiresIn),
-		}
-		rec.Data, err = encodeSession(session)
+func (ss *Store) Save(r *http.Request, w http.ResponseWriter, gs *sessions.Session) error {
+	state := ss.state(r, gs)
+	s := state.session
+	if gs.Options.MaxAge < 0 {
+		// Marked for deletion.
+		ss.transport().Set(w, gs.Name(), "", gs.Options)
+		return s.Destroy(r.Context())
+	}
+	cookieValue, err := s.Commit(r.Context())
+	copyFromSession(r, gs, state)
+	if err != nil {
+		return err
+	}
+	state.setCookie(w, ss.transport(), gs, cookieValue)
+	if state.remember != nil {
+		value, err := ss.RememberMe.Rotate(r.Context(), state.remember, s.ID)
 		if err != nil {
 			return err
 		}
-		if err := ss.DB.Save(r.Context(), &rec, -1); err != nil {
-			return err
-		}
-		if err = ss.Codec.Refresh(r.Context()); err != nil {
-			return err
+		state.remember = nil
+		if value != "" {
+			http.SetCookie(w, ss.rememberCookie(value, ss.RememberMe.CookieMaxAge()))
 		}
-		encoded, err := ss.Codec.Encode(session.Name(), sid)
-		if err != nil {
-			return err
+	}
+	if state.clearRemember {
+		http.SetCookie(w, ss.rememberCookie("", -1))
+		state.clearRemember = false
+	}
+	return nil
+}
+
+// RegenerateID gives the session a new session ID, while keeping its values.
+// It should be called whenever the privilege level of the session changes,
+// for example when the user logs in or out, to prevent session fixation attacks.
+//
+// The session values are saved using the new session ID and the session
+// cookie is sent with the new session ID. The record for the old session ID
+// is then deleted, or replaced with a tombstone record if the store has a
+// regenerate grace period.
+func (ss *Store) RegenerateID(r *http.Request, w http.ResponseWriter, gs *sessions.Session) error {
+	state := ss.state(r, gs)
+	cookieValue, err := state.session.RegenerateID(r.Context())
+	copyFromSession(r, gs, state)
+	if err != nil {
+		return err
+	}
+	state.setCookie(w, ss.transport(), gs, cookieValue)
+	return nil
+}
+
+// BindUser binds the session to the user identified by userID, so that the session
+// is included in the results of ListUserSessions and RevokeUserSessions. See
+// session.Session.BindUser for details. If the Manager has MaxUserSessions set,
+// BindUser can return a *SessionLimitError.
+//
+// The client IP address is obtained from the request's RemoteAddr. Headers such
+// as X-Forwarded-For are not consulted, so if the application is behind a proxy,
+// the request's RemoteAddr should be set accordingly before calling BindUser.
+func (ss *Store) BindUser(r *http.Request, gs *sessions.Session, userID string) error {
+	state := ss.state(r, gs)
+	s := state.session
+	s.ClientIP = remoteIP(r)
+	s.UserAgent = r.UserAgent()
+	err := s.BindUser(r.Context(), userID)
+	copyFromSession(r, gs, state)
+	return err
+}
+
+// SessionInfo returns metadata about the session, including the time it was
+// created and last used, and the client IP address and user agent of the
+// request that last used it. Use the Manager's LookupSession method to obtain
+// metadata about sessions other than the current one.
+func (ss *Store) SessionInfo(gs *sessions.Session) *SessionInfo {
+	return ss.state(nil, gs).session.Info()
+}
+
+// Degraded reports whether the session is anonymous and read-only because the
+// storage provider is unavailable. Changes to a degraded session are not saved.
+func (ss *Store) Degraded(gs *sessions.Session) bool {
+	return ss.state(nil, gs).session.Degraded()
+}
+
+// Remember issues a remember-me cookie for the user identified by userID, who has
+// just logged in. The session should already have been given a new ID using
+// RegenerateID, so that it can be revoked if the remember-me cookie is stolen.
+// Remember returns an error if the session does not have an ID yet.
+func (ss *Store) Remember(r *http.Request, w http.ResponseWriter, gs *sessions.Session, userID string) error {
+	if ss.RememberMe == nil {
+		return errors.New("remember-me not configured")
+	}
+	if gs.ID == "" {
+		return errors.New("session has not been saved").With("user", userID)
+	}
+	value, err := ss.RememberMe.Issue(r.Context(), userID, gs.ID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, ss.rememberCookie(value, ss.RememberMe.CookieMaxAge()))
+	return nil
+}
+
+// Forget deletes the request's remember-me cookie, so that it can no longer be
+// used to re-establish a session. It should be called when the user logs out.
+func (ss *Store) Forget(r *http.Request, w http.ResponseWriter) error {
+	if ss.RememberMe == nil {
+		return nil
+	}
+	c, err := r.Cookie(ss.RememberMe.CookieName())
+	if err != nil {
+		// no remember-me cookie
+		return nil
+	}
+	if err := ss.RememberMe.Forget(r.Context(), c.Value); err != nil {
+		return err
+	}
+	http.SetCookie(w, ss.rememberCookie("", -1))
+	return nil
+}
+
+// remember establishes a new session for the user remembered by the request's
+// remember-me cookie, if it has one.
+func (ss *Store) remember(r *http.Request, state *sessionState) error {
+	c, err := r.Cookie(ss.RememberMe.CookieName())
+	if err != nil {
+		// no remember-me cookie
+		return nil
+	}
+	login, err := ss.RememberMe.Check(r.Context(), c.Value)
+	if err != nil {
+		if _, ok := err.(*rememberme.TheftError); ok {
+			state.clearRemember = true
 		}
-		http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+		return err
+	}
+	if login == nil {
+		return nil
+	}
+	s := state.session
+	if key := ss.RememberMe.UserIDKey; key != "" {
+		s.Values[key] = login.UserID
 	}
+	if err := s.BindUser(r.Context(), login.UserID); err != nil {
+		return err
+	}
+	state.remember = login
 	return nil
 }
 
-// recordID returns the unique ID for saving a session record to persistent storage
-func (ss *Store) recordID(session *sessions.Session) string {
-	if ss.AppID == "" {
-		return session.ID
+// rememberCookie returns the remember-me cookie. A negative max age deletes the cookie.
+func (ss *Store) rememberCookie(value string, maxAge time.Duration) *http.Cookie {
+	options := ss.Options
+	options.HttpOnly = true
+	options.MaxAge = int(maxAge / time.Second)
+	if maxAge < 0 {
+		options.MaxAge = -1
+	}
+	return sessions.NewCookie(ss.RememberMe.CookieName(), value, &options)
+}
+
+// Token returns the encoded session value, which is the value of the session
+// cookie, or the bearer token when using BearerTransport. It returns an empty
+// string if the session has not been saved. This is useful for returning the
+// session value to API clients in the response body.
+func (ss *Store) Token(gs *sessions.Session) string {
+	if state := getState(nil, gs); state != nil {
+		return state.cookieValue
 	}
-	return ss.AppID + "-" + session.ID
+	return ""
 }
 
-func encodeSession(session *sessions.Session) ([]byte, error) {
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
-	if err := encoder.Encode(session.Values); err != nil {
-		return nil, errors.Wrap(err, "cannot encode session values")
+// transport returns the transport for session values.
+func (ss *Store) transport() Transport {
+	if ss.Transport == nil {
+		return CookieTransport{}
+	}
+	return ss.Transport
+}
+
+// manager returns the session manager for sessions with the specified name.
+func (ss *Store) manager(name string) *session.Manager {
+	m := ss.Manager
+	m.Name = name
+	return &m
+}
+
+// state returns the state for the Gorilla session, which contains the session
+// loaded by the manager. The manager's session is updated with the ID, values
+// and options of the Gorilla session, which the application may have changed.
+// The request r is nil for methods that do not have the request.
+func (ss *Store) state(r *http.Request, gs *sessions.Session) *sessionState {
+	state := getState(r, gs)
+	if state == nil {
+		state = &sessionState{
+			session: ss.manager(gs.Name()).NewSession(),
+			options: *gs.Options,
+		}
+		setState(r, gs, state)
 	}
-	return buf.Bytes(), nil
+	s := state.session
+	s.ID = gs.ID
+	s.Values = persistentValues(gs)
+	s.MaxAge = time.Duration(gs.Options.MaxAge) * time.Second
+	return state
 }
@@ -1 +1,339 @@
 package sessionstore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/sessions/rememberme"
+	"github.com/jjeffery/sessions/session"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+const testSessionName = "session"
+
+func TestStore(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "app")
+
+	// save returns the cookies sent when saving the session
+	save := func(session *sessions.Session) []*http.Cookie {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if err := store.Save(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		return w.Result().Cookies()
+	}
+
+	cookie := saveNewSession(t, store)
+	session := loadSession(t, store, cookie)
+	if got, want := session.IsNew, false; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// unchanged session does not send a cookie
+	if got, want := len(save(session)), 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// changed options require the cookie to be sent
+	session.Options.HttpOnly = !session.Options.HttpOnly
+	if got, want := len(save(session)), 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := len(save(session)), 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// negative max age deletes the session
+	session.Options.MaxAge = -1
+	cookies := save(session)
+	if got, want := len(cookies), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := cookies[0].Value, ""; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := loadSession(t, store, cookie).IsNew, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestStoreRegenerateID(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "app")
+	oldCookie := saveNewSession(t, store)
+	session := loadSession(t, store, oldCookie)
+	oldID := session.ID
+
+	w := httptest.NewRecorder()
+	if err := store.RegenerateID(httptest.NewRequest("GET", "/", nil), w, session); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if session.ID == oldID {
+		t.Fatalf("want different session ID")
+	}
+	cookies := w.Result().Cookies()
+	if got, want := len(cookies), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	session = loadSession(t, store, cookies[0])
+	if got, want := session.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := loadSession(t, store, oldCookie).IsNew, true; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestStoreMerge(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "")
+	store.OptimisticLocking = true
+	store.Merge = func(base, mine, theirs map[interface{}]interface{}) (map[interface{}]interface{}, error) {
+		for k, v := range theirs {
+			if _, ok := mine[k]; !ok {
+				mine[k] = v
+			}
+		}
+		return mine, nil
+	}
+	cookie := saveNewSession(t, store)
+	session1 := loadSession(t, store, cookie)
+	session2 := loadSession(t, store, cookie)
+
+	session1.Values["one"] = 1
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), session1); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	session2.Values["two"] = 2
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), session2); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	// merged values are copied to the Gorilla session
+	if got, want := session2.Values["one"], 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestStoreClearValues(t *testing.T) {
+	for _, locking := range []bool{false, true} {
+		store := New(memory.New(), sessions.Options{}, "app")
+		store.OptimisticLocking = locking
+		events := &MemorySink{}
+		store.Events = events
+		cookie := saveNewSession(t, store)
+		events.Reset()
+
+		// the application replaces the session values before saving
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		r.AddCookie(cookie)
+		gs, err := store.New(r, testSessionName)
+		if err != nil {
+			t.Fatalf("%v: got=%v, want=nil", locking, err)
+		}
+		gs.Values = map[interface{}]interface{}{"key": "replaced"}
+		w := httptest.NewRecorder()
+		if err := store.Save(r, w, gs); err != nil {
+			t.Fatalf("%v: got=%v, want=nil", locking, err)
+		}
+		if got, want := len(w.Result().Cookies()), 0; got != want {
+			t.Errorf("%v: got=%v, want=%v", locking, got, want)
+		}
+		if got, want := eventTypes(events), "loaded saved"; got != want {
+			t.Errorf("%v: got=%v, want=%v", locking, got, want)
+		}
+		if got, want := loadSession(t, store, cookie).Values["key"], "replaced"; got != want {
+			t.Errorf("%v: got=%v, want=%v", locking, got, want)
+		}
+
+		// all of the values are deleted, and the unchanged session is not saved
+		events.Reset()
+		r = httptest.NewRequest("GET", "http://localhost/", nil)
+		r.AddCookie(cookie)
+		if gs, err = store.New(r, testSessionName); err != nil {
+			t.Fatalf("%v: got=%v, want=nil", locking, err)
+		}
+		for k := range gs.Values {
+			delete(gs.Values, k)
+		}
+		gs.Values["key"] = "replaced"
+		if err := store.Save(r, httptest.NewRecorder(), gs); err != nil {
+			t.Fatalf("%v: got=%v, want=nil", locking, err)
+		}
+		if got, want := eventTypes(events), "loaded"; got != want {
+			t.Errorf("%v: got=%v, want=%v", locking, got, want)
+		}
+	}
+}
+
+// eventTypes returns the types of the events received by sink.
+func eventTypes(sink *MemorySink) string {
+	var types []string
+	for _, event := range sink.Events() {
+		types = append(types, event.Type.String())
+	}
+	return strings.Join(types, " ")
+}
+
+func TestStoreBindUser(t *testing.T) {
+	ctx := context.Background()
+	store := New(memory.New(), sessions.Options{}, "app")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "phone")
+	session, err := store.New(r, testSessionName)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if err := store.BindUser(r, session, "alice"); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if session.ID == "" {
+		t.Fatal("got=empty, want=session ID")
+	}
+	if err := store.Save(r, httptest.NewRecorder(), session); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+
+	list, err := store.ListUserSessions(ctx, "alice")
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(list), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+	if got, want := list[0].ID, session.ID; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := list[0].IP, "192.0.2.1"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := list[0].UserAgent, "phone"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestStoreSessionInfo(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "app")
+	cookie := saveNewSession(t, store)
+	session := loadSession(t, store, cookie)
+	info := store.SessionInfo(session)
+	if got, want := info.ID, session.ID; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if info.CreatedAt.IsZero() {
+		t.Error("got=zero, want=created at")
+	}
+	if got, want := info.ClientIP, "192.0.2.1"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+// saveNewSession creates and saves a new session, returning the session cookie.
+func saveNewSession(t *testing.T, store *Store) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	session, err := store.New(r, testSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["key"] = "value"
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got=%v, want=1", len(cookies))
+	}
+	return cookies[0]
+}
+
+// loadSession loads the session for the cookie.
+func loadSession(t *testing.T, store *Store, cookie *http.Cookie) *sessions.Session {
+	t.Helper()
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	r.AddCookie(cookie)
+	session, err := store.New(r, testSessionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestStoreFingerprint(t *testing.T) {
+	store := New(memory.New(), sessions.Options{}, "app")
+	store.Fingerprint = session.ClientIPPrefix
+	store.FingerprintPolicy = session.FingerprintFlag
+	cookie := saveNewSession(t, store)
+
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.AddCookie(cookie)
+	gs, err := store.New(r, testSessionName)
+	if _, ok := err.(*FingerprintError); !ok {
+		t.Fatalf("got=%v, want=*FingerprintError", err)
+	}
+	if got, want := gs.Values["key"], "value"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
+
+func TestStoreRememberMe(t *testing.T) {
+	db := memory.New()
+	store := New(db, sessions.Options{}, "app")
+	store.RememberMe = rememberme.New(db, &store.Manager, "app")
+
+	// log in and ask to be remembered
+	r := httptest.NewRequest("GET", "http://localhost/", nil)
+	gs, err := store.New(r, testSessionName)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	w := httptest.NewRecorder()
+	if err := store.Remember(r, w, gs, "alice"); err == nil {
+		t.Fatal("got=nil, want=error for session without an ID")
+	}
+	if err := store.RegenerateID(r, w, gs); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if err := store.Remember(r, w, gs, "alice"); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	var remember *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == store.RememberMe.CookieName() {
+			remember = c
+		}
+	}
+	if remember == nil {
+		t.Fatal("got=nil, want=remember-me cookie")
+	}
+
+	// a request without a session cookie re-establishes the session
+	r = httptest.NewRequest("GET", "http://localhost/", nil)
+	r.AddCookie(remember)
+	gs, err = store.New(r, testSessionName)
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := gs.Values["user_id"], "alice"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	w = httptest.NewRecorder()
+	if err := store.Save(r, w, gs); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	names := make(map[string]bool)
+	for _, c := range w.Result().Cookies() {
+		names[c.Name] = true
+	}
+	if !names[testSessionName] || !names[store.RememberMe.CookieName()] {
+		t.Errorf("got=%v, want=session and remember-me cookies", names)
+	}
+}
@@ -0,0 +1,142 @@
+package sessionstore
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/sessions/rememberme"
+	"github.com/jjeffery/sessions/session"
+)
+
+// stateKey is the key used to store the session state in the session values.
+// It is not exported, so it cannot clash with any keys used by the application.
+type stateKey struct{}
+
+// registryKey is the key for the state registry in the request context.
+type registryKey struct{}
+
+// sessionState contains information about a Gorilla session that is needed
+// by the store, but is not part of the session values. The session state is
+// kept in a registry in the request context, so that it is not lost if the
+// application replaces or clears the session values. It is also kept in the
+// session values using a private key, for the methods that do not have the
+// request, and it is never persisted with the session values.
+type sessionState struct {
+	session     *session.Session // session loaded by the manager
+	cookieValue string           // session cookie value received or last sent
+	options     sessions.Options // options of the cookie received or last sent
+
+	remember      *rememberme.Login // login that re-established the session
+	clearRemember bool              // remember-me cookie was stolen, so clear it
+}
+
+// registry contains the state of the Gorilla sessions loaded by the store
+// during a request.
+type registry struct {
+	mutex  sync.Mutex
+	states map[*sessions.Session]*sessionState
+}
+
+// getRegistry returns the state registry for the request. If the request context
+// does not have a registry, one is added in the same way as sessions.GetRegistry,
+// by replacing the request's context.
+func getRegistry(r *http.Request) *registry {
+	if reg, ok := r.Context().Value(registryKey{}).(*registry); ok {
+		return reg
+	}
+	reg := newRegistry()
+	*r = *r.WithContext(context.WithValue(r.Context(), registryKey{}, reg))
+	return reg
+}
+
+func newRegistry() *registry {
+	return &registry{states: make(map[*sessions.Session]*sessionState)}
+}
+
+// getState returns the state for the session, or nil if the session
+// does not have any state. A session does not have state until it has been
+// loaded by the store's New method. The state is looked up in the request's
+// registry, or if r is nil or the session was loaded by another request, in
+// the session values.
+func getState(r *http.Request, gs *sessions.Session) *sessionState {
+	if r != nil {
+		if reg, ok := r.Context().Value(registryKey{}).(*registry); ok {
+			reg.mutex.Lock()
+			state := reg.states[gs]
+			reg.mutex.Unlock()
+			if state != nil {
+				return state
+			}
+		}
+	}
+	state, _ := gs.Values[stateKey{}].(*sessionState)
+	return state
+}
+
+// setState sets the state for the session. If r is nil, the state is only kept
+// in the session values.
+func setState(r *http.Request, gs *sessions.Session, state *sessionState) {
+	if r != nil {
+		reg := getRegistry(r)
+		reg.mutex.Lock()
+		reg.states[gs] = state
+		reg.mutex.Unlock()
+	}
+	gs.Values[stateKey{}] = state
+}
+
+// persistentValues returns the session values that should be persisted,
+// which excludes the session state.
+func persistentValues(gs *sessions.Session) map[interface{}]interface{} {
+	if _, ok := gs.Values[stateKey{}]; !ok {
+		return gs.Values
+	}
+	values := make(map[interface{}]interface{}, len(gs.Values))
+	for k, v := range gs.Values {
+		if _, ok := k.(stateKey); !ok {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// copyFromSession updates the Gorilla session with the ID and values of the
+// session loaded by the manager, which may have been changed when the session
+// was loaded or committed.
+func copyFromSession(r *http.Request, gs *sessions.Session, state *sessionState) {
+	s := state.session
+	gs.ID = s.ID
+	gs.IsNew = s.IsNew
+	for k := range gs.Values {
+		if _, ok := s.Values[k]; !ok {
+			delete(gs.Values, k)
+		}
+	}
+	for k, v := range s.Values {
+		gs.Values[k] = v
+	}
+	setState(r, gs, state)
+}
+
+// setCookie sends the session cookie using the transport if its value or options
+// have changed since it was received or last sent.
+func (state *sessionState) setCookie(w http.ResponseWriter, transport Transport, gs *sessions.Session, cookieValue string) {
+	if cookieValue == state.cookieValue && *gs.Options == state.options {
+		return
+	}
+	transport.Set(w, gs.Name(), cookieValue, gs.Options)
+	state.cookieValue = cookieValue
+	state.options = *gs.Options
+}
+
+// remoteIP returns the IP address of the client that sent the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,85 @@
+package sessionstore
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// Transport carries the encoded session value between the client and the Store.
+// The value is the same codec-encoded value that is otherwise sent in the session
+// cookie, so it is encrypted and authenticated regardless of the transport.
+type Transport interface {
+	// Get returns the session value sent by the client with the request, or an
+	// empty string if the request does not have a session value.
+	Get(r *http.Request, name string) string
+
+	// Set sends the session value to the client with the response. An empty
+	// value means that the client should discard its session value. The options
+	// are the session's cookie options, which transports other than cookies
+	// can ignore.
+	Set(w http.ResponseWriter, name string, value string, options *sessions.Options)
+}
+
+// CookieTransport is the default Transport, which sends the session value in
+// a cookie with the session name.
+type CookieTransport struct{}
+
+// Get implements the Transport interface.
+func (CookieTransport) Get(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		// http.ErrNoCookie is the only error returned
+		return ""
+	}
+	return c.Value
+}
+
+// Set implements the Transport interface.
+func (CookieTransport) Set(w http.ResponseWriter, name string, value string, options *sessions.Options) {
+	http.SetCookie(w, sessions.NewCookie(name, value, options))
+}
+
+// BearerTransport is a Transport for API clients, which send the session value
+// as a bearer token in the Authorization request header. The session value is
+// returned in the ResponseHeader response header whenever it changes. Use the
+// Store's Token method to return the session value in the response body instead.
+type BearerTransport struct {
+	ResponseHeader string // "Session-Token" if empty
+}
+
+// Get implements the Transport interface.
+func (t BearerTransport) Get(r *http.Request, name string) string {
+	const prefix = "bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// Set implements the Transport interface.
+func (t BearerTransport) Set(w http.ResponseWriter, name string, value string, options *sessions.Options) {
+	header := t.ResponseHeader
+	if header == "" {
+		header = "Session-Token"
+	}
+	w.Header().Set(header, value)
+}
+
+// HeaderTransport is a Transport that sends the session value in the same custom
+// header in both requests and responses.
+type HeaderTransport struct {
+	Header string // header name, eg "X-Session"
+}
+
+// Get implements the Transport interface.
+func (t HeaderTransport) Get(r *http.Request, name string) string {
+	return r.Header.Get(t.Header)
+}
+
+// Set implements the Transport interface.
+func (t HeaderTransport) Set(w http.ResponseWriter, name string, value string, options *sessions.Options) {
+	w.Header().Set(t.Header, value)
+}
@@ -0,0 +1,72 @@
+package sessionstore
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		transport Transport
+		header    string // response header containing the session value
+		setHeader func(value string) (string, string)
+	}{
+		{
+			transport: BearerTransport{},
+			header:    "Session-Token",
+			setHeader: func(value string) (string, string) { return "Authorization", "bearer " + value },
+		},
+		{
+			transport: HeaderTransport{Header: "X-Session"},
+			header:    "X-Session",
+			setHeader: func(value string) (string, string) { return "X-Session", value },
+		},
+	}
+	for i, tt := range tests {
+		store := New(memory.New(), sessions.Options{}, "app")
+		store.Transport = tt.transport
+
+		r := httptest.NewRequest("GET", "/", nil)
+		gs, err := store.New(r, testSessionName)
+		if err != nil {
+			t.Fatalf("%d: got=%v, want=nil", i, err)
+		}
+		gs.Values["key"] = "value"
+		w := httptest.NewRecorder()
+		if err := store.Save(r, w, gs); err != nil {
+			t.Fatalf("%d: got=%v, want=nil", i, err)
+		}
+		if got, want := len(w.Result().Cookies()), 0; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+		token := w.Header().Get(tt.header)
+		if token == "" {
+			t.Fatalf("%d: got=empty, want=session value", i)
+		}
+		if got, want := store.Token(gs), token; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(tt.setHeader(token))
+		gs, err = store.New(r, testSessionName)
+		if err != nil {
+			t.Fatalf("%d: got=%v, want=nil", i, err)
+		}
+		if got, want := gs.Values["key"], "value"; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+
+		// unchanged session value is not sent again
+		w = httptest.NewRecorder()
+		if err := store.Save(r, w, gs); err != nil {
+			t.Fatalf("%d: got=%v, want=nil", i, err)
+		}
+		if got, want := w.Header().Get(tt.header), ""; got != want {
+			t.Errorf("%d: got=%v, want=%v", i, got, want)
+		}
+	}
+}
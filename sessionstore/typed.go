@@ -0,0 +1,180 @@
+//go:build go1.18
+// +build go1.18
+
+package sessionstore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/errors"
+)
+
+// Keys for the session values used by Typed. The keys are strings so that
+// they can be serialized by all of the built-in serializers.
+const (
+	typedDataKey    = "sessionstore.typed.data"
+	typedVersionKey = "sessionstore.typed.version"
+)
+
+func init() {
+	// the JSON data model is used for the value, and gob needs
+	// to know about the map type used for JSON objects
+	gob.Register(map[string]interface{}{})
+}
+
+// Typed provides type-safe access to session data. Instead of a map of session
+// values, each session contains a single value of type T, which is usually a
+// struct.
+//
+// The value is kept in the session values in the form used by encoding/json when
+// decoding into an interface{}, except that integers are int64 or uint64 so that
+// large integers are not rounded. The value is encoded once by the store's
+// serializer, and can be decoded by any serializer, but T must be able to be
+// encoded as JSON. Unlike session values, the types used in T do not
+// need to be registered with gob.Register.
+//
+// Version is the schema version of T, and is saved with each value. It should be
+// incremented whenever a change to T means that previously saved values can no
+// longer be decoded into T. If a saved value has a different schema version, then
+// Migrate is called with the saved schema version and a function that decodes the
+// saved value. Migrate can then decode the saved value into the previous version
+// of the type, and convert it into a value of type T. If Migrate is nil, values
+// with a different schema version are decoded directly into T.
+//
+// If the request context was created by Middleware for the same store and
+// session name, Typed uses the session loaded by the middleware. Otherwise it
+// uses the Gorilla sessions registry.
+type Typed[T any] struct {
+	Store   *Store
+	Name    string // session name, which is also the cookie name
+	Version int    // schema version of T
+	Migrate func(version int, decode func(v interface{}) error) (*T, error)
+}
+
+// Load returns the value in the session for the request. If the session does not
+// contain a value, Load returns a pointer to the zero value of T.
+func (tp *Typed[T]) Load(r *http.Request) (*T, error) {
+	session, err := tp.session(r)
+	if err != nil {
+		return nil, err
+	}
+	errors := errors.With("session", tp.Name)
+	raw, ok := session.Values[typedDataKey]
+	if !ok {
+		return new(T), nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode session value")
+	}
+	decode := func(v interface{}) error {
+		return json.Unmarshal(data, v)
+	}
+	if version := intValue(session.Values[typedVersionKey]); version != tp.Version && tp.Migrate != nil {
+		v, err := tp.Migrate(version, decode)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot migrate session value").With("version", version)
+		}
+		return v, nil
+	}
+	v := new(T)
+	if err := decode(v); err != nil {
+		return nil, errors.Wrap(err, "cannot decode session value")
+	}
+	return v, nil
+}
+
+// Save saves v in the session for the request.
+func (tp *Typed[T]) Save(w http.ResponseWriter, r *http.Request, v *T) error {
+	session, err := tp.session(r)
+	if session == nil {
+		return err
+	}
+	// If there was an error loading the session, a new session is saved.
+	value, err := typedValue(v)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode session value").With("session", tp.Name)
+	}
+	session.Values[typedDataKey] = value
+	session.Values[typedVersionKey] = tp.Version
+	return tp.Store.Save(r, w, session)
+}
+
+// session returns the session for the request.
+func (tp *Typed[T]) session(r *http.Request) (*sessions.Session, error) {
+	if loader, ok := r.Context().Value(contextKey{}).(*sessionLoader); ok {
+		if loader.store == tp.Store && loader.name == tp.Name {
+			return loader.load()
+		}
+	}
+	return tp.Store.Get(r, tp.Name)
+}
+
+// typedValue returns v in the form used by encoding/json when decoding
+// into an interface{}, which all of the built-in serializers can encode.
+// Integers are int64 or uint64 instead of float64, so that integers that
+// cannot be represented exactly by a float64 are not changed.
+func typedValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return typedNumbers(value)
+}
+
+// typedNumbers replaces the json.Number values in v, which has been decoded
+// using UseNumber, with int64 or uint64 values for integers, and float64 values
+// for other numbers.
+func typedNumbers(v interface{}) (interface{}, error) {
+	var err error
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		for k, e := range v {
+			if v[k], err = typedNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			if v[i], err = typedNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// intValue returns the integer value of v, which may have been deserialized
+// as any numeric type. It returns zero if v is not a number.
+func intValue(v interface{}) int {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return int(rv.Float())
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+//go:build go1.18
+// +build go1.18
+
+package sessionstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+type testCartV1 struct {
+	Items []string
+}
+
+type testCart struct {
+	Items    map[string]int
+	Discount string
+}
+
+func TestTyped(t *testing.T) {
+	for _, serializer := range []SessionSerializer{
+		GobSerializer{},
+		JSONSerializer{},
+		MessagePackSerializer{},
+	} {
+		t.Run(serializer.Format(), func(t *testing.T) {
+			testTyped(t, serializer)
+		})
+	}
+}
+
+func testTyped(t *testing.T, serializer SessionSerializer) {
+	store := New(memory.New(), sessions.Options{}, "app")
+	store.Serializer = serializer
+
+	// save returns the session cookie
+	save := func(save func(w http.ResponseWriter, r *http.Request) error) *http.Cookie {
+		t.Helper()
+		w := httptest.NewRecorder()
+		if err := save(w, httptest.NewRequest("GET", "/", nil)); err != nil {
+			t.Fatalf("got=%v, want=nil", err)
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("got=%v, want=1", len(cookies))
+		}
+		return cookies[0]
+	}
+	request := func(cookie *http.Cookie) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		return r
+	}
+
+	v1 := &Typed[testCartV1]{Store: store, Name: testSessionName, Version: 1}
+	cookie := save(func(w http.ResponseWriter, r *http.Request) error {
+		return v1.Save(w, r, &testCartV1{Items: []string{"apple", "apple", "pear"}})
+	})
+	cart1, err := v1.Load(request(cookie))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := len(cart1.Items), 3; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	// the value is kept in its decoded form, so it is only serialized once
+	if _, ok := loadSession(t, store, cookie).Values[typedDataKey].(map[string]interface{}); !ok {
+		t.Errorf("got=%T, want=map[string]interface{}", loadSession(t, store, cookie).Values[typedDataKey])
+	}
+
+	// new schema version migrates the old value
+	v2 := &Typed[testCart]{
+		Store:   store,
+		Name:    testSessionName,
+		Version: 2,
+		Migrate: func(version int, decode func(v interface{}) error) (*testCart, error) {
+			if version != 1 {
+				t.Errorf("got=%v, want=1", version)
+			}
+			var old testCartV1
+			if err := decode(&old); err != nil {
+				return nil, err
+			}
+			cart := &testCart{Items: make(map[string]int)}
+			for _, item := range old.Items {
+				cart.Items[item]++
+			}
+			return cart, nil
+		},
+	}
+	cart, err := v2.Load(request(cookie))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := cart.Items["apple"], 2; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// migrated value is saved using the new schema version
+	cart.Discount = "SALE"
+	r := request(cookie)
+	if err := v2.Save(httptest.NewRecorder(), r, cart); err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	v2.Migrate = nil
+	cart, err = v2.Load(request(cookie))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if got, want := cart.Discount, "SALE"; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := cart.Items["pear"], 1; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	// new session has the zero value
+	cart, err = v2.Load(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("got=%v, want=nil", err)
+	}
+	if cart == nil || cart.Items != nil {
+		t.Errorf("got=%v, want zero value", cart)
+	}
+}
+
+type testAccount struct {
+	UserID  int64
+	OrgID   uint64
+	Balance float64
+}
+
+func TestTypedLargeIntegers(t *testing.T) {
+	for _, serializer := range []SessionSerializer{
+		GobSerializer{},
+		JSONSerializer{},
+		MessagePackSerializer{},
+	} {
+		t.Run(serializer.Format(), func(t *testing.T) {
+			store := New(memory.New(), sessions.Options{}, "app")
+			store.Serializer = serializer
+			typed := &Typed[testAccount]{Store: store, Name: testSessionName}
+			want := testAccount{
+				UserID:  1<<62 + 1,
+				OrgID:   1<<64 - 1,
+				Balance: 12.5,
+			}
+			w := httptest.NewRecorder()
+			if err := typed.Save(w, httptest.NewRequest("GET", "/", nil), &want); err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			for _, cookie := range w.Result().Cookies() {
+				r.AddCookie(cookie)
+			}
+			got, err := typed.Load(r)
+			if err != nil {
+				t.Fatalf("got=%v, want=nil", err)
+			}
+			if *got != want {
+				t.Errorf("got=%+v, want=%+v", *got, want)
+			}
+		})
+	}
+}
@@ -5,4 +5,15 @@
 //  Hash Key: name="id" type="S"
 //  Sort Key: none
 //  Time to Live Attribute: name="expires_at"
+//  Global Secondary Index: name="index_key-index"
+//    Hash Key: name="index_key" type="S"
+//    Projection: all attributes
+//
+// Each item also has the optional attributes "created_at", "last_seen_at" (unix
+// time, type="N"), "client_ip" and "user_agent" (type="S"), which contain metadata
+// about the session, and can be used in queries.
+//
+// The global secondary index is used by the ListIndexed method. It is created
+// by the CreateTable method, but it needs to be added to any table that was
+// created by an earlier version of this package.
 package dynamodb
@@ -14,19 +14,42 @@ import (
 
 // unversionedRecord represents an unversioned record in the DynamoDB table
 type unversionedRecord struct {
-	ID        string                 `dynamodbav:"id"`
-	Values    map[string]interface{} `dynamodbav:"values"`
-	ExpiresAt int64                  `dynamodbav:"expires_at"`
+	ID         string                 `dynamodbav:"id"`
+	Values     map[string]interface{} `dynamodbav:"values"`
+	ExpiresAt  int64                  `dynamodbav:"expires_at"`
+	CreatedAt  int64                  `dynamodbav:"created_at,omitempty"`
+	LastSeenAt int64                  `dynamodbav:"last_seen_at,omitempty"`
+	ClientIP   string                 `dynamodbav:"client_ip,omitempty"`
+	UserAgent  string                 `dynamodbav:"user_agent,omitempty"`
+	IndexKey   string                 `dynamodbav:"index_key,omitempty"`
 }
 
 // versionedRecord represents a versioned record in the DynamoDB table
 type versionedRecord struct {
-	ID        string                 `dynamodbav:"id"`
-	Version   int64                  `dynamodbav:"version"`
-	Values    map[string]interface{} `dynamodbav:"values"`
-	ExpiresAt int64                  `dynamodbav:"expires_at"`
+	ID         string                 `dynamodbav:"id"`
+	Version    int64                  `dynamodbav:"version"`
+	Values     map[string]interface{} `dynamodbav:"values"`
+	ExpiresAt  int64                  `dynamodbav:"expires_at"`
+	CreatedAt  int64                  `dynamodbav:"created_at,omitempty"`
+	LastSeenAt int64                  `dynamodbav:"last_seen_at,omitempty"`
+	ClientIP   string                 `dynamodbav:"client_ip,omitempty"`
+	UserAgent  string                 `dynamodbav:"user_agent,omitempty"`
+	IndexKey   string                 `dynamodbav:"index_key,omitempty"`
 }
 
+// indexName is the name of the global secondary index on the index_key attribute.
+const indexName = "index_key-index"
+
+var (
+	// ensure Provider implements the storage interfaces
+	_ storage.Provider = (*Provider)(nil)
+	_ storage.Lister   = (*Provider)(nil)
+	_ storage.Purger   = (*Provider)(nil)
+	_ storage.Toucher  = (*Provider)(nil)
+	_ storage.Upgrader = (*Provider)(nil)
+	_ storage.Indexer  = (*Provider)(nil)
+)
+
 // Provider provides storage for sessions using an AWS DynamoDB table.
 // It implements the storage.Provider interface.
 //
@@ -54,6 +77,10 @@ func (db *Provider) CreateTable(readCapacityUnits, writeCapacityUnits int64) err
 				AttributeName: aws.String("id"),
 				AttributeType: aws.String("S"),
 			},
+			{
+				AttributeName: aws.String("index_key"),
+				AttributeType: aws.String("S"),
+			},
 		},
 		KeySchema: []*dynamodb.KeySchemaElement{
 			{
@@ -61,6 +88,24 @@ func (db *Provider) CreateTable(readCapacityUnits, writeCapacityUnits int64) err
 				KeyType:       aws.String(dynamodb.KeyTypeHash),
 			},
 		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(indexName),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{
+						AttributeName: aws.String("index_key"),
+						KeyType:       aws.String(dynamodb.KeyTypeHash),
+					},
+				},
+				Projection: &dynamodb.Projection{
+					ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+				},
+				ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+					ReadCapacityUnits:  aws.Int64(readCapacityUnits),
+					WriteCapacityUnits: aws.Int64(writeCapacityUnits),
+				},
+			},
+		},
 
 		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
 			ReadCapacityUnits:  aws.Int64(readCapacityUnits),
@@ -125,26 +170,157 @@ func (db *Provider) Fetch(ctx context.Context, id string) (*storage.Record, erro
 		// not found
 		return nil, nil
 	}
-	var rec versionedRecord
-	if err := dynamodbattribute.UnmarshalMap(output.Item, &rec); err != nil {
+	rec, err := itemToRecord(output.Item)
+	if err != nil {
 		return nil, errors.Wrap(err, "unable to unmarshal record")
 	}
+	return rec, nil
+}
+
+// List implements the storage.Lister interface.
+//
+// The DynamoDB table is scanned using a filter expression, so each page
+// of the scan reads up to pageSize items from the table, some of which may
+// not match the prefix.
+func (db *Provider) List(ctx context.Context, prefix string, pageSize int) storage.Iterator {
+	if pageSize <= 0 {
+		pageSize = storage.DefaultPageSize
+	}
+	fetch := func(ctx context.Context, cursor string) ([]*storage.Record, string, error) {
+		errors := errors.With("prefix", prefix, "cursor", cursor, "table", db.tableName)
+		input := &dynamodb.ScanInput{
+			TableName: aws.String(db.tableName),
+			Limit:     aws.Int64(int64(pageSize)),
+		}
+		if prefix != "" {
+			input.ExpressionAttributeNames = map[string]*string{
+				"#id": aws.String("id"),
+			}
+			input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+				":prefix": {S: aws.String(prefix)},
+			}
+			input.FilterExpression = aws.String("begins_with(#id, :prefix)")
+		}
+		if cursor != "" {
+			input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+				"id": {S: aws.String(cursor)},
+			}
+		}
+		output, err := db.dynamodb.ScanWithContext(ctx, input)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "cannot scan table")
+		}
+		recs := make([]*storage.Record, 0, len(output.Items))
+		for _, item := range output.Items {
+			rec, err := itemToRecord(item)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "unable to unmarshal record")
+			}
+			recs = append(recs, rec)
+		}
+		var next string
+		if key := output.LastEvaluatedKey["id"]; key != nil && key.S != nil {
+			next = *key.S
+		}
+		return recs, next, nil
+	}
+	return storage.NewIterator(ctx, fetch)
+}
+
+// ListIndexed implements the storage.Indexer interface.
+//
+// The records are found by querying the global secondary index on the
+// index_key attribute, which is described in the package comment.
+func (db *Provider) ListIndexed(ctx context.Context, key string, pageSize int) storage.Iterator {
+	if pageSize <= 0 {
+		pageSize = storage.DefaultPageSize
+	}
+	fetch := func(ctx context.Context, cursor string) ([]*storage.Record, string, error) {
+		errors := errors.With("key", key, "cursor", cursor, "table", db.tableName)
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(db.tableName),
+			IndexName:              aws.String(indexName),
+			KeyConditionExpression: aws.String("#index_key = :key"),
+			ExpressionAttributeNames: map[string]*string{
+				"#index_key": aws.String("index_key"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":key": {S: aws.String(key)},
+			},
+			Limit: aws.Int64(int64(pageSize)),
+		}
+		if cursor != "" {
+			input.ExclusiveStartKey = map[string]*dynamodb.AttributeValue{
+				"id":        {S: aws.String(cursor)},
+				"index_key": {S: aws.String(key)},
+			}
+		}
+		output, err := db.dynamodb.QueryWithContext(ctx, input)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "cannot query index")
+		}
+		recs := make([]*storage.Record, 0, len(output.Items))
+		for _, item := range output.Items {
+			rec, err := itemToRecord(item)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "unable to unmarshal record")
+			}
+			recs = append(recs, rec)
+		}
+		var next string
+		if key := output.LastEvaluatedKey["id"]; key != nil && key.S != nil {
+			next = *key.S
+		}
+		return recs, next, nil
+	}
+	return storage.NewIterator(ctx, fetch)
+}
+
+// itemToRecord converts a DynamoDB item into a storage record.
+func itemToRecord(item map[string]*dynamodb.AttributeValue) (*storage.Record, error) {
+	var rec versionedRecord
+	if err := dynamodbattribute.UnmarshalMap(item, &rec); err != nil {
+		return nil, err
+	}
 	data, _ := rec.Values["Data"].([]byte)
 	format, _ := rec.Values["Format"].(string)
-	return &storage.Record{
+	srec := &storage.Record{
 		ID:        rec.ID,
 		Version:   rec.Version,
+		IndexKey:  rec.IndexKey,
 		Format:    format,
 		Data:      data,
 		ExpiresAt: time.Unix(rec.ExpiresAt, 0),
-	}, nil
+	}
+	if rec.CreatedAt != 0 {
+		srec.CreatedAt = time.Unix(rec.CreatedAt, 0)
+	}
+	if rec.LastSeenAt != 0 {
+		srec.LastSeenAt = time.Unix(rec.LastSeenAt, 0)
+	}
+	srec.ClientIP = rec.ClientIP
+	srec.UserAgent = rec.UserAgent
+	return srec, nil
+}
+
+// unixTime returns the unix time of t, or zero if t is the zero time.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
 }
 
 func (db *Provider) Save(ctx context.Context, rec *storage.Record, oldVersion int64) error {
 	if oldVersion < 0 {
 		uvrec := unversionedRecord{
-			ID:        rec.ID,
-			ExpiresAt: rec.ExpiresAt.Unix(),
+			ID:         rec.ID,
+			ExpiresAt:  rec.ExpiresAt.Unix(),
+			CreatedAt:  unixTime(rec.CreatedAt),
+			LastSeenAt: unixTime(rec.LastSeenAt),
+			ClientIP:   rec.ClientIP,
+			UserAgent:  rec.UserAgent,
+			IndexKey:   rec.IndexKey,
 			Values: map[string]interface{}{
 				"Data":   rec.Data,
 				"Format": rec.Format,
@@ -152,16 +328,34 @@ func (db *Provider) Save(ctx context.Context, rec *storage.Record, oldVersion in
 		}
 		return db.putUnversioned(ctx, &uvrec)
 	}
-	vrec := versionedRecord{
-		ID:        rec.ID,
-		Version:   rec.Version,
-		ExpiresAt: rec.ExpiresAt.Unix(),
+	return db.putVersioned(ctx, newVersionedRecord(rec), oldVersion)
+}
+
+// Upgrade implements the storage.Upgrader interface.
+func (db *Provider) Upgrade(ctx context.Context, rec *storage.Record) error {
+	return db.putVersioned(ctx, newVersionedRecord(rec), unversioned)
+}
+
+// unversioned is passed to putVersioned as the old version to replace an
+// unversioned item.
+const unversioned = -1
+
+// newVersionedRecord converts a storage record into a versioned record.
+func newVersionedRecord(rec *storage.Record) *versionedRecord {
+	return &versionedRecord{
+		ID:         rec.ID,
+		Version:    rec.Version,
+		ExpiresAt:  rec.ExpiresAt.Unix(),
+		CreatedAt:  unixTime(rec.CreatedAt),
+		LastSeenAt: unixTime(rec.LastSeenAt),
+		ClientIP:   rec.ClientIP,
+		UserAgent:  rec.UserAgent,
+		IndexKey:   rec.IndexKey,
 		Values: map[string]interface{}{
 			"Data":   rec.Data,
 			"Format": rec.Format,
 		},
 	}
-	return db.putVersioned(ctx, &vrec, oldVersion)
 }
 
 func (db *Provider) putUnversioned(ctx context.Context, rec *unversionedRecord) error {
@@ -194,6 +388,11 @@ func (db *Provider) putVersioned(ctx context.Context, rec *versionedRecord, oldV
 		input.ExpressionAttributeNames = make(map[string]*string)
 		input.ExpressionAttributeNames["#id"] = aws.String("id")
 		input.ConditionExpression = aws.String("attribute_not_exists(#id)")
+	} else if oldVersion == unversioned {
+		input.ExpressionAttributeNames = make(map[string]*string)
+		input.ExpressionAttributeNames["#id"] = aws.String("id")
+		input.ExpressionAttributeNames["#version"] = aws.String("version")
+		input.ConditionExpression = aws.String("attribute_exists(#id) and attribute_not_exists(#version)")
 	} else {
 		input.ExpressionAttributeNames = make(map[string]*string)
 		input.ExpressionAttributeNames["#version"] = aws.String("version")
@@ -234,6 +433,103 @@ func (db *Provider) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
+// Touch implements the storage.Toucher interface.
+func (db *Provider) Touch(ctx context.Context, id string, expiresAt, lastSeenAt time.Time) error {
+	errors := errors.With("id", id, "table", db.tableName)
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(db.tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {
+				S: aws.String(id),
+			},
+		},
+		UpdateExpression:    aws.String("SET #expires_at = :expires_at, #last_seen_at = :last_seen_at"),
+		ConditionExpression: aws.String("attribute_exists(#id) AND #expires_at >= :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":           aws.String("id"),
+			"#expires_at":   aws.String("expires_at"),
+			"#last_seen_at": aws.String("last_seen_at"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":expires_at":   {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+			":last_seen_at": {N: aws.String(strconv.FormatInt(unixTime(lastSeenAt), 10))},
+			":now":          {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}
+	if _, err := db.dynamodb.UpdateItemWithContext(ctx, input); err != nil {
+		if hasErrorCode(err, "ConditionalCheckFailedException") {
+			// record does not exist, or has expired
+			return nil
+		}
+		return errors.Wrap(err, "unable to update record")
+	}
+	return nil
+}
+
+// PurgeN implements the storage.Purger interface.
+//
+// DynamoDB deletes expired items using its time to live feature, but this
+// can happen some time after the items have expired. PurgeN scans the table
+// for expired items and deletes them immediately. Each item is deleted
+// with a condition that it is still expired, so that an item that is
+// updated during the purge is not deleted.
+func (db *Provider) PurgeN(ctx context.Context, limit int) (int, error) {
+	if limit <= 0 {
+		limit = storage.DefaultPurgeLimit
+	}
+	errors := errors.With("table", db.tableName)
+	names := map[string]*string{
+		"#id":         aws.String("id"),
+		"#expires_at": aws.String("expires_at"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+	}
+	var count int
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		input := &dynamodb.ScanInput{
+			TableName:                 aws.String(db.tableName),
+			ProjectionExpression:      aws.String("#id"),
+			FilterExpression:          aws.String("#expires_at < :now"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+			ExclusiveStartKey:         startKey,
+			Limit:                     aws.Int64(int64(limit - count)),
+		}
+		output, err := db.dynamodb.ScanWithContext(ctx, input)
+		if err != nil {
+			return count, errors.Wrap(err, "cannot scan table")
+		}
+		for _, item := range output.Items {
+			input := &dynamodb.DeleteItemInput{
+				TableName: aws.String(db.tableName),
+				Key: map[string]*dynamodb.AttributeValue{
+					"id": item["id"],
+				},
+				ConditionExpression: aws.String("#expires_at < :now"),
+				ExpressionAttributeNames: map[string]*string{
+					"#expires_at": aws.String("expires_at"),
+				},
+				ExpressionAttributeValues: values,
+			}
+			if _, err := db.dynamodb.DeleteItemWithContext(ctx, input); err != nil {
+				if hasErrorCode(err, "ConditionalCheckFailedException") {
+					// item has been updated since the scan
+					continue
+				}
+				return count, errors.Wrap(err, "unable to delete record")
+			}
+			count++
+		}
+		if count >= limit || len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		startKey = output.LastEvaluatedKey
+	}
+	return count, nil
+}
+
 func hasErrorCode(err error, code string) bool {
 	if coder, ok := err.(interface{ Code() string }); ok {
 		return coder.Code() == code
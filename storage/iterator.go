@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+)
+
+// PageFunc fetches one page of records for an Iterator. The cursor is
+// a blank string when fetching the first page, otherwise it is the value
+// of next returned from the previous call.
+//
+// A page can contain no records, which can happen if the database applies
+// a filter after selecting the records for the page. A blank value for
+// next indicates that there are no more pages.
+type PageFunc func(ctx context.Context, cursor string) (records []*Record, next string, err error)
+
+// NewIterator returns an Iterator that fetches records one page at a time
+// by calling fetch. It is intended for use by Provider implementations
+// of the Lister interface.
+//
+// The iterator checks ctx before fetching each page, and stops with the
+// context error if ctx is done.
+func NewIterator(ctx context.Context, fetch PageFunc) Iterator {
+	return &pageIterator{
+		ctx:   ctx,
+		fetch: fetch,
+	}
+}
+
+// pageIterator implements the Iterator interface.
+type pageIterator struct {
+	ctx     context.Context
+	fetch   PageFunc
+	cursor  string
+	started bool
+	page    []*Record
+	rec     *Record
+	err     error
+}
+
+// Next implements the Iterator interface.
+func (it *pageIterator) Next() bool {
+	it.rec = nil
+	if it.err != nil {
+		return false
+	}
+	for len(it.page) == 0 {
+		if it.started && it.cursor == "" {
+			// no more pages
+			return false
+		}
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		page, next, err := it.fetch(it.ctx, it.cursor)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.started = true
+		it.page = page
+		it.cursor = next
+	}
+	it.rec = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+// Record implements the Iterator interface.
+func (it *pageIterator) Record() *Record {
+	return it.rec
+}
+
+// Err implements the Iterator interface.
+func (it *pageIterator) Err() error {
+	return it.err
+}
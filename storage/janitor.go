@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPurgeInterval is the time between purges if the Janitor
+	// interval is not specified.
+	DefaultPurgeInterval = time.Hour
+)
+
+var (
+	// jitterMutex protects jitterRand, which is not safe for concurrent use
+	jitterMutex sync.Mutex
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Janitor deletes expired records on a regular schedule.
+//
+// The Interval field specifies the time between purges. If zero, then
+// DefaultPurgeInterval is used.
+//
+// The Jitter field specifies the maximum random duration added to each
+// interval. This prevents multiple processes started at the same time from
+// purging at the same time. If zero, then one tenth of the interval is used.
+// If negative, then no jitter is added.
+//
+// The BatchSize field specifies the maximum number of records deleted
+// by each call to Purger.PurgeN. If zero, then DefaultPurgeLimit is used.
+//
+// The OnPurge field, if not nil, is called after each purge with the
+// number of records deleted, and the error (if any) that stopped the purge.
+// It is useful for logging and metrics.
+type Janitor struct {
+	Purger    Purger
+	Interval  time.Duration
+	Jitter    time.Duration
+	BatchSize int
+	OnPurge   func(count int, err error)
+}
+
+// Run purges expired records on a regular schedule until ctx is done.
+// It always returns a non-nil error, which is the context error.
+//
+// Run is typically called in its own goroutine:
+//
+//	ctx, cancel := context.WithCancel(context.Background())
+//	defer cancel()
+//	go janitor.Run(ctx)
+func (j *Janitor) Run(ctx context.Context) error {
+	for {
+		timer := time.NewTimer(j.nextWait())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		count, err := j.Purge(ctx)
+		if j.OnPurge != nil {
+			j.OnPurge(count, err)
+		}
+	}
+}
+
+// Purge deletes all expired records, one batch at a time. It returns
+// the number of records deleted. If ctx is done, Purge stops deleting
+// records and returns the context error.
+func (j *Janitor) Purge(ctx context.Context) (int, error) {
+	batchSize := j.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPurgeLimit
+	}
+	var total int
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		count, err := j.Purger.PurgeN(ctx, batchSize)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		if count < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// nextWait returns the duration to wait before the next purge.
+func (j *Janitor) nextWait() time.Duration {
+	interval := j.Interval
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+	jitter := j.Jitter
+	if jitter == 0 {
+		jitter = interval / 10
+	}
+	if jitter > 0 {
+		jitterMutex.Lock()
+		interval += time.Duration(jitterRand.Int63n(int64(jitter)))
+		jitterMutex.Unlock()
+	}
+	return interval
+}
@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jjeffery/sessions/storage"
+	"github.com/jjeffery/sessions/storage/memory"
+)
+
+func TestJanitor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := memory.New()
+	for i := 0; i < 25; i++ {
+		rec := storage.Record{
+			ID:        fmt.Sprintf("expired-%d", i),
+			ExpiresAt: time.Now().Add(-time.Minute),
+		}
+		if err := db.Save(ctx, &rec, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged := make(chan int)
+	janitor := storage.Janitor{
+		Purger:    db,
+		Interval:  time.Millisecond,
+		BatchSize: 10,
+		OnPurge: func(count int, err error) {
+			if err != nil {
+				t.Errorf("got=%v, want=nil", err)
+			}
+			purged <- count
+		},
+	}
+	done := make(chan error)
+	go func() {
+		done <- janitor.Run(ctx)
+	}()
+
+	if got, want := <-purged, 25; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := <-purged, 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+
+	cancel()
+	for {
+		select {
+		case <-purged:
+			continue
+		case err := <-done:
+			if got, want := err, context.Canceled; got != want {
+				t.Errorf("got=%v, want=%v", got, want)
+			}
+		}
+		break
+	}
+}
+
+func TestJanitorCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	janitor := storage.Janitor{Purger: memory.New()}
+	count, err := janitor.Purge(ctx)
+	if got, want := err, context.Canceled; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := count, 0; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+	if got, want := janitor.Run(ctx), context.Canceled; got != want {
+		t.Errorf("got=%v, want=%v", got, want)
+	}
+}
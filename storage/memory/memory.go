@@ -3,12 +3,24 @@ package memory
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/jjeffery/sessions/storage"
 )
 
+var (
+	// ensure Provider implements the storage interfaces
+	_ storage.Provider = (*Provider)(nil)
+	_ storage.Lister   = (*Provider)(nil)
+	_ storage.Purger   = (*Provider)(nil)
+	_ storage.Toucher  = (*Provider)(nil)
+	_ storage.Upgrader = (*Provider)(nil)
+	_ storage.Indexer  = (*Provider)(nil)
+)
+
 // Provider implements the storage.Provider using memory. It is intended for testing.
 type Provider struct {
 	// TimeNow is used to obtain the current time.
@@ -71,6 +83,26 @@ func (db *Provider) Save(ctx context.Context, rec *storage.Record, oldVersion in
 	if db.m == nil {
 		db.m = make(map[string]*storage.Record)
 	}
+	rec = cloneRecord(rec)
+	if oldVersion < 0 {
+		// the version of an unversioned record is ignored
+		rec.Version = 0
+	}
+	db.m[rec.ID] = rec
+	return nil
+}
+
+// Upgrade implements the storage.Upgrader interface.
+func (db *Provider) Upgrade(ctx context.Context, rec *storage.Record) error {
+	if rec.Version <= 0 {
+		// should never happen, panic if this happens during testing
+		panic("invalid rec.Version")
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if existing := db.m[rec.ID]; existing == nil || existing.Version != 0 {
+		return storage.ErrVersionConflict
+	}
 	db.m[rec.ID] = cloneRecord(rec)
 	return nil
 }
@@ -83,6 +115,84 @@ func (db *Provider) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
+// Touch implements the storage.Toucher interface.
+func (db *Provider) Touch(ctx context.Context, id string, expiresAt, lastSeenAt time.Time) error {
+	now := db.TimeNow()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if rec := db.m[id]; rec != nil && !rec.ExpiresAt.Before(now) {
+		// an expired record cannot be brought back to life
+		rec.ExpiresAt = expiresAt
+		rec.LastSeenAt = lastSeenAt
+	}
+	return nil
+}
+
+// List implements the storage.Lister interface.
+func (db *Provider) List(ctx context.Context, prefix string, pageSize int) storage.Iterator {
+	return db.list(ctx, pageSize, func(rec *storage.Record) bool {
+		return strings.HasPrefix(rec.ID, prefix)
+	})
+}
+
+// ListIndexed implements the storage.Indexer interface.
+func (db *Provider) ListIndexed(ctx context.Context, key string, pageSize int) storage.Iterator {
+	return db.list(ctx, pageSize, func(rec *storage.Record) bool {
+		return rec.IndexKey == key
+	})
+}
+
+// list returns an iterator over all unexpired records that match.
+func (db *Provider) list(ctx context.Context, pageSize int, match func(*storage.Record) bool) storage.Iterator {
+	if pageSize <= 0 {
+		pageSize = storage.DefaultPageSize
+	}
+	fetch := func(ctx context.Context, cursor string) ([]*storage.Record, string, error) {
+		now := db.TimeNow()
+		db.mutex.RLock()
+		defer db.mutex.RUnlock()
+		var ids []string
+		for id, rec := range db.m {
+			if id > cursor && match(rec) && !rec.ExpiresAt.Before(now) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		var next string
+		if len(ids) > pageSize {
+			ids = ids[:pageSize]
+			next = ids[pageSize-1]
+		}
+		recs := make([]*storage.Record, 0, len(ids))
+		for _, id := range ids {
+			recs = append(recs, cloneRecord(db.m[id]))
+		}
+		return recs, next, nil
+	}
+	return storage.NewIterator(ctx, fetch)
+}
+
+// PurgeN implements the storage.Purger interface.
+func (db *Provider) PurgeN(ctx context.Context, limit int) (int, error) {
+	if limit <= 0 {
+		limit = storage.DefaultPurgeLimit
+	}
+	now := db.TimeNow()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	var count int
+	for id, rec := range db.m {
+		if count >= limit {
+			break
+		}
+		if rec.ExpiresAt.Before(now) {
+			delete(db.m, id)
+			count++
+		}
+	}
+	return count, nil
+}
+
 // cloneRecord copies a record, but does not do a very good job
 // with the Values field.
 func cloneRecord(rec *storage.Record) *storage.Record {
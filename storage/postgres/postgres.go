@@ -5,9 +5,19 @@
 //    id character varying(255) primary key,
 //    version integer null,
 //    expires_at timestamp with time zone null,
+//    created_at timestamp with time zone null,
+//    last_seen_at timestamp with time zone null,
+//    client_ip character varying null,
+//    user_agent character varying null,
+//    index_key character varying(255) null,
 //    format character varying null,
 //    data bytea null
-//  )
+//  );
+//  create index <table_name>_index_key_idx on <table_name>(index_key);
+//
+// The CreateTable method creates the table if it does not exist, and adds any
+// columns that are missing from a table created by an earlier version of this
+// package.
 package postgres
 
 import (
@@ -15,6 +25,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jjeffery/errors"
@@ -31,10 +42,21 @@ type Provider struct {
 }
 
 var (
-	// ensure Provider implements storage.Provider
+	// ensure Provider implements the storage interfaces
 	_ storage.Provider = (*Provider)(nil)
+	_ storage.Lister   = (*Provider)(nil)
+	_ storage.Purger   = (*Provider)(nil)
+	_ storage.Toucher  = (*Provider)(nil)
+	_ storage.Upgrader = (*Provider)(nil)
+	_ storage.Indexer  = (*Provider)(nil)
 )
 
+// recordColumns is the list of columns selected by scanRecord.
+const recordColumns = "id, version, expires_at, created_at, last_seen_at, client_ip, user_agent, index_key, format, data"
+
+// likeEscaper escapes the special characters in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 // New creates a new Provider given a database handle and the PostgreSQL table name.
 func New(db *sql.DB, tableName string) *Provider {
 	if tableName == "" {
@@ -46,13 +68,19 @@ func New(db *sql.DB, tableName string) *Provider {
 	}
 }
 
-// CreateTable creates the dynamodb table.
+// CreateTable creates the database table if it does not already exist.
+// If the table does exist, any missing columns are added.
 func (db *Provider) CreateTable() error {
 	errors := errors.With("table", db.tableName)
 	queryFmt := `create table if not exists %s(` +
 		`id character varying(255) primary key,` +
 		` version integer null,` +
 		` expires_at timestamp with time zone null,` +
+		` created_at timestamp with time zone null,` +
+		` last_seen_at timestamp with time zone null,` +
+		` client_ip character varying null,` +
+		` user_agent character varying null,` +
+		` index_key character varying(255) null,` +
 		` format character varying null,` +
 		` data bytea null)`
 	query := fmt.Sprintf(queryFmt, db.tableName)
@@ -61,6 +89,26 @@ func (db *Provider) CreateTable() error {
 		return errors.Wrap(err, "cannot create table")
 	}
 
+	// columns added since the first version of the table
+	columns := []string{
+		"created_at timestamp with time zone null",
+		"index_key character varying(255) null",
+		"last_seen_at timestamp with time zone null",
+		"client_ip character varying null",
+		"user_agent character varying null",
+	}
+	for _, column := range columns {
+		query := fmt.Sprintf("alter table %s add column if not exists %s", db.tableName, column)
+		if _, err := db.db.ExecContext(ctx, query); err != nil {
+			return errors.Wrap(err, "cannot add column").With("column", column)
+		}
+	}
+
+	query = fmt.Sprintf("create index if not exists %[1]s_index_key_idx on %[1]s(index_key)", db.tableName)
+	if _, err := db.db.ExecContext(ctx, query); err != nil {
+		return errors.Wrap(err, "cannot create index")
+	}
+
 	return nil
 }
 
@@ -84,18 +132,8 @@ func (db *Provider) Fetch(ctx context.Context, id string) (*storage.Record, erro
 	}
 	defer tx.Rollback()
 
-	var version sql.NullInt64
-	var expires nullTime
-	var format sql.NullString
-	var data []byte
-
-	query := fmt.Sprintf("select version, expires_at, format, data from %s where id = $1", db.tableName)
-	err = db.db.QueryRowContext(ctx, query, id).Scan(
-		&version,
-		&expires,
-		&format,
-		&data,
-	)
+	query := fmt.Sprintf("select %s from %s where id = $1", recordColumns, db.tableName)
+	rec, err := scanRecord(db.db.QueryRowContext(ctx, query, id))
 	if err == sql.ErrNoRows {
 		// not found
 		return nil, nil
@@ -103,19 +141,6 @@ func (db *Provider) Fetch(ctx context.Context, id string) (*storage.Record, erro
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot get record").With("query", query)
 	}
-	rec := &storage.Record{
-		ID: id,
-	}
-	if version.Valid {
-		rec.Version = version.Int64
-	}
-	if expires.Valid {
-		rec.ExpiresAt = expires.Time
-	}
-	if format.Valid {
-		rec.Format = format.String
-	}
-	rec.Data = data
 	if err := tx.Commit(); err != nil {
 		return nil, errors.Wrap(err, "cannot commit tx")
 	}
@@ -145,15 +170,18 @@ func (db *Provider) saveUnversioned(ctx context.Context, rec *storage.Record) er
 		format.String = rec.Format
 	}
 
-	var expires nullTime
-	if !rec.ExpiresAt.IsZero() {
-		expires.Valid = true
-		expires.Time = rec.ExpiresAt
-	}
-	queryFmt := `insert into %s(id, expires_at, format, data) values($1, $2, $3, $4)` +
-		` on conflict(id) do update set version = null, expires_at = $2, format = $3, data = $4`
+	expires := newNullTime(rec.ExpiresAt)
+	created := newNullTime(rec.CreatedAt)
+	lastSeen := newNullTime(rec.LastSeenAt)
+	clientIP := newNullString(rec.ClientIP)
+	userAgent := newNullString(rec.UserAgent)
+	indexKey := newNullString(rec.IndexKey)
+	queryFmt := `insert into %s(id, expires_at, created_at, last_seen_at, client_ip, user_agent, index_key, format, data)` +
+		` values($1, $2, $3, $4, $5, $6, $7, $8, $9)` +
+		` on conflict(id) do update set version = null, expires_at = $2, created_at = $3, last_seen_at = $4,` +
+		` client_ip = $5, user_agent = $6, index_key = $7, format = $8, data = $9`
 	query := fmt.Sprintf(queryFmt, db.tableName)
-	if _, err := tx.ExecContext(ctx, query, rec.ID, expires, format, rec.Data); err != nil {
+	if _, err := tx.ExecContext(ctx, query, rec.ID, expires, created, lastSeen, clientIP, userAgent, indexKey, format, rec.Data); err != nil {
 		return errors.Wrap(err, "cannot update row")
 	}
 	if err := tx.Commit(); err != nil {
@@ -163,6 +191,15 @@ func (db *Provider) saveUnversioned(ctx context.Context, rec *storage.Record) er
 	return nil
 }
 
+// unversioned is passed to saveVersioned as the old version to replace an
+// unversioned row.
+const unversioned = -1
+
+// Upgrade implements the storage.Upgrader interface.
+func (db *Provider) Upgrade(ctx context.Context, rec *storage.Record) error {
+	return db.saveVersioned(ctx, rec, unversioned)
+}
+
 func (db *Provider) saveVersioned(ctx context.Context, rec *storage.Record, oldVersion int64) error {
 	errors := errors.With("id", rec.ID, "table", db.tableName)
 	tx, err := db.db.BeginTx(ctx, nil)
@@ -177,18 +214,20 @@ func (db *Provider) saveVersioned(ctx context.Context, rec *storage.Record, oldV
 		format.String = rec.Format
 	}
 
-	var expires nullTime
-	if !rec.ExpiresAt.IsZero() {
-		expires.Valid = true
-		expires.Time = rec.ExpiresAt
-	}
+	expires := newNullTime(rec.ExpiresAt)
+	created := newNullTime(rec.CreatedAt)
+	lastSeen := newNullTime(rec.LastSeenAt)
+	clientIP := newNullString(rec.ClientIP)
+	userAgent := newNullString(rec.UserAgent)
+	indexKey := newNullString(rec.IndexKey)
 
 	var rowCount int64
 	if oldVersion == 0 {
-		queryFmt := `insert into %s(id, version, expires_at, format, data) values($1, $2, $3, $4, $5)` +
+		queryFmt := `insert into %s(id, version, expires_at, created_at, last_seen_at, client_ip, user_agent, index_key, format, data)` +
+			` values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)` +
 			` on conflict(id) do nothing`
 		query := fmt.Sprintf(queryFmt, db.tableName)
-		result, err := tx.ExecContext(ctx, query, rec.ID, rec.Version, expires, format, rec.Data)
+		result, err := tx.ExecContext(ctx, query, rec.ID, rec.Version, expires, created, lastSeen, clientIP, userAgent, indexKey, format, rec.Data)
 		if err != nil {
 			return errors.Wrap(err, "cannot insert row")
 		}
@@ -197,11 +236,18 @@ func (db *Provider) saveVersioned(ctx context.Context, rec *storage.Record, oldV
 			return errors.Wrap(err, "cannot get rows affected")
 		}
 	} else {
-		queryFmt := `update %s set version = $1, expires_at = $2, format = $3, data = $4` +
-			` where id = $5` +
-			` and version = $6`
+		queryFmt := `update %s set version = $1, expires_at = $2, created_at = $3, last_seen_at = $4,` +
+			` client_ip = $5, user_agent = $6, index_key = $7, format = $8, data = $9` +
+			` where id = $10`
+		args := []interface{}{rec.Version, expires, created, lastSeen, clientIP, userAgent, indexKey, format, rec.Data, rec.ID}
+		if oldVersion == unversioned {
+			queryFmt += ` and version is null`
+		} else {
+			queryFmt += ` and version = $11`
+			args = append(args, oldVersion)
+		}
 		query := fmt.Sprintf(queryFmt, db.tableName)
-		result, err := tx.ExecContext(ctx, query, rec.Version, expires, format, rec.Data, rec.ID, oldVersion)
+		result, err := tx.ExecContext(ctx, query, args...)
 		if err != nil {
 			return errors.Wrap(err, "cannot update row")
 		}
@@ -241,7 +287,75 @@ func (db *Provider) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
-// Purge deletes all expired records.
+// Touch implements the storage.Toucher interface.
+func (db *Provider) Touch(ctx context.Context, id string, expiresAt, lastSeenAt time.Time) error {
+	errors := errors.With("id", id, "table", db.tableName)
+	queryFmt := `update %s set expires_at = $1, last_seen_at = $2` +
+		` where id = $3` +
+		` and (expires_at is null or expires_at >= now())`
+	query := fmt.Sprintf(queryFmt, db.tableName)
+	if _, err := db.db.ExecContext(ctx, query, newNullTime(expiresAt), newNullTime(lastSeenAt), id); err != nil {
+		return errors.Wrap(err, "cannot update row")
+	}
+	return nil
+}
+
+// List implements the storage.Lister interface.
+//
+// Records are returned in order of their ID, and the database is queried
+// using a LIKE condition on the primary key. For best performance with large
+// tables, the id column should use the "C" collation, or have an index that
+// uses the text_pattern_ops operator class.
+func (db *Provider) List(ctx context.Context, prefix string, pageSize int) storage.Iterator {
+	pattern := likeEscaper.Replace(prefix) + "%"
+	return db.list(ctx, `id like $1 escape '\'`, pattern, pageSize)
+}
+
+// ListIndexed implements the storage.Indexer interface.
+//
+// Records are returned in order of their ID.
+func (db *Provider) ListIndexed(ctx context.Context, key string, pageSize int) storage.Iterator {
+	return db.list(ctx, "index_key = $1", key, pageSize)
+}
+
+// list returns an iterator over the records that match the condition,
+// which has one parameter ($1) whose value is arg.
+func (db *Provider) list(ctx context.Context, condition string, arg string, pageSize int) storage.Iterator {
+	if pageSize <= 0 {
+		pageSize = storage.DefaultPageSize
+	}
+	queryFmt := `select %s from %s where %s and id > $2 order by id limit $3`
+	query := fmt.Sprintf(queryFmt, recordColumns, db.tableName, condition)
+	fetch := func(ctx context.Context, cursor string) ([]*storage.Record, string, error) {
+		errors := errors.With("arg", arg, "cursor", cursor, "table", db.tableName)
+		rows, err := db.db.QueryContext(ctx, query, arg, cursor, pageSize)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "cannot list records").With("query", query)
+		}
+		defer rows.Close()
+		var recs []*storage.Record
+		for rows.Next() {
+			rec, err := scanRecord(rows)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "cannot scan record")
+			}
+			recs = append(recs, rec)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, "", errors.Wrap(err, "cannot list records").With("query", query)
+		}
+		var next string
+		if len(recs) == pageSize {
+			next = recs[len(recs)-1].ID
+		}
+		return recs, next, nil
+	}
+	return storage.NewIterator(ctx, fetch)
+}
+
+// Purge deletes all expired records. Use PurgeN to delete expired records
+// in batches, so that a large number of expired records does not result in
+// a long-running transaction.
 func (db *Provider) Purge(ctx context.Context) error {
 	errors := errors.With("table", db.tableName)
 	tx, err := db.db.BeginTx(ctx, nil)
@@ -250,7 +364,6 @@ func (db *Provider) Purge(ctx context.Context) error {
 	}
 	defer tx.Rollback()
 
-	// TODO(jpj): would be more robust to have a limit
 	query := fmt.Sprintf("delete from %s where expires_at < now()", db.tableName)
 	if _, err := tx.ExecContext(ctx, query); err != nil {
 		return errors.Wrap(err, "cannot delete row")
@@ -262,11 +375,109 @@ func (db *Provider) Purge(ctx context.Context) error {
 	return nil
 }
 
+// PurgeN implements the storage.Purger interface.
+func (db *Provider) PurgeN(ctx context.Context, limit int) (int, error) {
+	if limit <= 0 {
+		limit = storage.DefaultPurgeLimit
+	}
+	errors := errors.With("table", db.tableName)
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot begin tx")
+	}
+	defer tx.Rollback()
+
+	queryFmt := `delete from %[1]s where id in` +
+		` (select id from %[1]s where expires_at < now() limit $1)`
+	query := fmt.Sprintf(queryFmt, db.tableName)
+	result, err := tx.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot delete rows")
+	}
+	rowCount, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot get rows affected")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "cannot commit tx")
+	}
+
+	return int(rowCount), nil
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRecord scans a record whose columns were selected using recordColumns.
+func scanRecord(row scanner) (*storage.Record, error) {
+	var id string
+	var version sql.NullInt64
+	var expires nullTime
+	var created nullTime
+	var lastSeen nullTime
+	var clientIP sql.NullString
+	var userAgent sql.NullString
+	var indexKey sql.NullString
+	var format sql.NullString
+	var data []byte
+
+	if err := row.Scan(&id, &version, &expires, &created, &lastSeen, &clientIP, &userAgent, &indexKey, &format, &data); err != nil {
+		return nil, err
+	}
+	rec := &storage.Record{
+		ID:   id,
+		Data: data,
+	}
+	if version.Valid {
+		rec.Version = version.Int64
+	}
+	if expires.Valid {
+		rec.ExpiresAt = expires.Time
+	}
+	if created.Valid {
+		rec.CreatedAt = created.Time
+	}
+	if lastSeen.Valid {
+		rec.LastSeenAt = lastSeen.Time
+	}
+	if clientIP.Valid {
+		rec.ClientIP = clientIP.String
+	}
+	if userAgent.Valid {
+		rec.UserAgent = userAgent.String
+	}
+	if indexKey.Valid {
+		rec.IndexKey = indexKey.String
+	}
+	if format.Valid {
+		rec.Format = format.String
+	}
+	return rec, nil
+}
+
 type nullTime struct {
 	Time  time.Time
 	Valid bool // Valid is true if Time is not NULL
 }
 
+// newNullString returns a sql.NullString that is NULL if s is blank.
+func newNullString(s string) sql.NullString {
+	return sql.NullString{
+		String: s,
+		Valid:  s != "",
+	}
+}
+
+// newNullTime returns a nullTime that is NULL if t is the zero time.
+func newNullTime(t time.Time) nullTime {
+	return nullTime{
+		Time:  t,
+		Valid: !t.IsZero(),
+	}
+}
+
 // Scan implements the Scanner interface.
 func (nt *nullTime) Scan(value interface{}) error {
 	nt.Time, nt.Valid = value.(time.Time)
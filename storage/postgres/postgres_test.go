@@ -52,6 +52,21 @@ func TestPurge(t *testing.T) {
 	if got, want := countRows(), 1; got != want {
 		t.Fatalf("got=%v, want=%v", got, want)
 	}
+
+	rec.ID = "zzz"
+	rec.ExpiresAt = time.Now().Add(-time.Second)
+	err = stg.Save(ctx, &rec, -1)
+	wantNoError(t, err)
+
+	count, err := stg.PurgeN(ctx, 0)
+	wantNoError(t, err)
+	if got, want := count, 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
+
+	if got, want := countRows(), 1; got != want {
+		t.Fatalf("got=%v, want=%v", got, want)
+	}
 }
 
 func newDBFunc(t *testing.T) func() storage.Provider {
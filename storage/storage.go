@@ -12,6 +12,14 @@ import (
 const (
 	// MaxIDLength is the maximum allowed length of a Record.ID field.
 	MaxIDLength = 255
+
+	// DefaultPageSize is the number of records retrieved in each page
+	// by a Lister if the page size is not specified.
+	DefaultPageSize = 100
+
+	// DefaultPurgeLimit is the maximum number of records deleted by
+	// a Purger in one call if the limit is not specified.
+	DefaultPurgeLimit = 1000
 )
 
 var (
@@ -21,12 +29,21 @@ var (
 )
 
 // Record contains information that is persisted to the Provider.
+//
+// The LastSeenAt, ClientIP and UserAgent fields contain metadata about the client
+// using a session. Providers persist them in their own columns or attributes so
+// that they can be queried.
 type Record struct {
-	ID        string    // unique identifer, maximum length 255 bytes
-	Version   int64     // optimistic locking version, must be > 0
-	ExpiresAt time.Time // time that this record expires, and can be deleted
-	Format    string    // arbitrary string that can be used to interpret the contents of Data
-	Data      []byte    // opaque data to be stored
+	ID         string    // unique identifer, maximum length 255 bytes
+	Version    int64     // optimistic locking version, must be > 0
+	ExpiresAt  time.Time // time that this record expires, and can be deleted
+	CreatedAt  time.Time // time that this record was first created, can be zero
+	LastSeenAt time.Time // time that this record was last used, can be zero
+	ClientIP   string    // optional IP address of the client
+	UserAgent  string    // optional user agent of the client
+	IndexKey   string    // optional key for finding related records, see Indexer
+	Format     string    // arbitrary string that can be used to interpret the contents of Data
+	Data       []byte    // opaque data to be stored
 }
 
 // Provider is the interface used by the session store for persisting session information
@@ -58,3 +75,97 @@ type Provider interface {
 	// is not an error if the record does not exist.
 	Delete(ctx context.Context, id string) error
 }
+
+// Lister is an optional interface that can be implemented by a Provider.
+// It provides the ability to iterate over all records whose ID begins with
+// a given prefix, which is useful for administration and migration tasks.
+type Lister interface {
+	// List returns an iterator over all records whose ID begins with prefix.
+	// An empty prefix matches all records.
+	//
+	// Records are retrieved from the database one page at a time, with at most
+	// pageSize records in each page. If pageSize is zero or negative, then
+	// DefaultPageSize is used.
+	//
+	// Records are not guaranteed to be returned in any particular order, and
+	// the iterator may return records that have expired but have not yet
+	// been deleted.
+	List(ctx context.Context, prefix string, pageSize int) Iterator
+}
+
+// Iterator iterates over a sequence of records.
+//
+//	iter := lister.List(ctx, prefix, 0)
+//	for iter.Next() {
+//		rec := iter.Record()
+//		// ... process rec
+//	}
+//	if err := iter.Err(); err != nil {
+//		// ... handle error
+//	}
+type Iterator interface {
+	// Next advances the iterator to the next record, which will then be
+	// available via the Record method. It returns false when there are no
+	// more records, or if an error occurs.
+	Next() bool
+
+	// Record returns the current record.
+	Record() *Record
+
+	// Err returns the error, if any, that was encountered during iteration.
+	Err() error
+}
+
+// Purger is an optional interface that can be implemented by a Provider.
+// It provides the ability to delete expired records in batches.
+type Purger interface {
+	// PurgeN deletes at most limit expired records, and returns the number
+	// of records deleted. If limit is zero or negative, then DefaultPurgeLimit
+	// is used.
+	//
+	// To delete all expired records, call PurgeN repeatedly until it returns
+	// fewer records than the limit. The Janitor does this on a regular schedule.
+	PurgeN(ctx context.Context, limit int) (int, error)
+}
+
+// Toucher is an optional interface that can be implemented by a Provider.
+// It provides the ability to extend the expiry time of a record without
+// rewriting the record's data, which is useful for sliding expiration.
+type Toucher interface {
+	// Touch updates the expiry time and the last seen time of the record with
+	// the unique ID. No other fields of the record are changed, including the
+	// version. It is not an error if the record does not exist.
+	Touch(ctx context.Context, id string, expiresAt, lastSeenAt time.Time) error
+}
+
+// Upgrader is an optional interface that can be implemented by a Provider.
+// It provides the ability to replace an unversioned record with a versioned
+// record, which is needed when records that were saved without a version
+// start to be saved with optimistic locking.
+type Upgrader interface {
+	// Upgrade saves a record with the version in rec.Version, provided that
+	// the matching record in the database is unversioned. If there is no
+	// matching record in the database, or it has a version, then Upgrade
+	// returns ErrVersionConflict.
+	Upgrade(ctx context.Context, rec *Record) error
+}
+
+// Indexer is an optional interface that can be implemented by a Provider.
+// It provides the ability to efficiently find all records that have the same
+// value in their IndexKey field.
+//
+// A Provider that does not implement Indexer is not required to persist the
+// IndexKey field.
+type Indexer interface {
+	// ListIndexed returns an iterator over all records whose IndexKey field
+	// is equal to key. The key cannot be blank.
+	//
+	// Records are retrieved from the database one page at a time, with at most
+	// pageSize records in each page. If pageSize is zero or negative, then
+	// DefaultPageSize is used.
+	//
+	// Records are not guaranteed to be returned in any particular order, and
+	// the iterator may return records that have expired but have not yet
+	// been deleted.
+	ListIndexed(ctx context.Context, key string, pageSize int) Iterator
+}